@@ -2,6 +2,7 @@ package clt
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -12,8 +13,6 @@ import (
 	"net/url"
 	"strings"
 
-	"github.com/gravitational/teleport/integration"
-	"github.com/gravitational/teleport/lib/client"
 	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/utils"
 
@@ -28,9 +27,16 @@ import (
 // new Teleport proxy instances
 type APIClient struct {
 	SessionID     string
+	ObserverID    string
+	PIN           string
+	OwnerToken    string
+	KnockID       string
+	Name          string
 	Endpoint      *url.URL
 	clientVersion string
 	httpClient    http.Client
+	// out receives the messages for humans
+	out io.Writer
 }
 
 // NewAPIClient creates and returns the new API client
@@ -38,17 +44,21 @@ func NewAPIClient(config *conf.Config, clientVersion string) *APIClient {
 	client := &APIClient{
 		Endpoint:      config.APIEndpointURL,
 		clientVersion: clientVersion,
+		out:           config.GetMessageOut(),
 	}
 	// create cookie storage:
 	client.httpClient.Jar, _ = cookiejar.New(nil)
 
+	// a stuck server must not hang us:
+	client.httpClient.Timeout = config.GetAPITimeout()
+
 	// disable automatic redirects
 	client.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
 
 	if config.InsecureHTTPS {
-		fmt.Println("\033[1mWARNING:\033[0m running in insecure mode!")
+		fmt.Fprintln(client.out, "\033[1mWARNING:\033[0m running in insecure mode!")
 		client.httpClient.Transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
@@ -58,7 +68,7 @@ func NewAPIClient(config *conf.Config, clientVersion string) *APIClient {
 
 // Sends the version of the client to the server and receives a session
 // cookie. Every new API conversation must start here
-func (this *APIClient) CheckVersion() error {
+func (this *APIClient) CheckVersion(ctx context.Context) error {
 	var (
 		resp *http.Response
 		err  error
@@ -68,7 +78,7 @@ func (this *APIClient) CheckVersion() error {
 	for i := 0; i <= maxRedirects; i++ {
 		log.Infof("Getting version from %s", this.Endpoint)
 		// Request server's version (and report ours):
-		resp, err = this.GET("/api/version")
+		resp, err = this.GET(ctx, "/api/version")
 		if err != nil {
 			log.Error(err)
 			return trace.Wrap(err)
@@ -99,7 +109,7 @@ func (this *APIClient) CheckVersion() error {
 	}
 	// display server-supplied warning message:
 	if sv.WarningMsg != "" {
-		fmt.Println("\033[1mWARNING:\033[0m", sv.WarningMsg)
+		fmt.Fprintln(this.out, "\033[1mWARNING:\033[0m", sv.WarningMsg)
 	}
 	log.Infof("Connecting to https://%s", this.Endpoint.Host)
 	return nil
@@ -108,12 +118,11 @@ func (this *APIClient) CheckVersion() error {
 // RequestNewSession makes an HTTP call to a Telecast server, passing the SSH secrets
 // of the local session.
 //
-// The server will create a disposable SSH proxy pre-configured to trust this instance
-func (this *APIClient) RequestNewSession(
-	login string,
-	secrets integration.InstanceSecrets,
-	hostPort string, fport *client.ForwardedPort) (*lib.Session, error) {
-	log.Infof("Requesting a new session for %v forwarding %v", login, fport)
+// The server will create a disposable SSH proxy pre-configured to trust this instance.
+// 'session' must have the secrets, login and the node address filled in, the
+// session IDs are generated here
+func (this *APIClient) RequestNewSession(ctx context.Context, session *lib.Session, observers bool) (*lib.Session, error) {
+	log.Infof("Requesting a new session for %v forwarding %v", session.Login, session.ForwardedPorts)
 
 	// generate a random session ID:
 	var err error
@@ -122,14 +131,16 @@ func (this *APIClient) RequestNewSession(
 		log.Error(err)
 		return nil, trace.Wrap(err)
 	}
-	// create a session here on the client, pack our trusted secrets to it and send it
-	// to the server via HTTPS:
-	session := &lib.Session{
-		ID:            this.SessionID,
-		Secrets:       secrets,
-		Login:         login,
-		NodeHostPort:  hostPort,
-		ForwardedPort: fport,
+	// read-only observers get their own session ID:
+	if observers {
+		if this.ObserverID, err = utils.CryptoRandomHex(20); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	session.ID = this.SessionID
+	session.ObserverID = this.ObserverID
+	if len(session.ForwardedPorts) > 0 {
+		session.ForwardedPort = &session.ForwardedPorts[0].ForwardedPort
 	}
 	// POST http://server/sessions
 	sessionBytes, err := json.Marshal(session)
@@ -137,11 +148,12 @@ func (this *APIClient) RequestNewSession(
 		log.Error(err)
 		return nil, trace.Wrap(err)
 	}
-	resp, err := this.POST("/api/sessions", "application/json", bytes.NewBuffer(sessionBytes))
+	resp, err := this.POST(ctx, "/api/sessions", "application/json", bytes.NewBuffer(sessionBytes))
 	if err != nil {
 		log.Error(err)
 		return nil, trace.Wrap(err)
 	}
+	defer resp.Body.Close()
 	// HTTP error:
 	if resp.StatusCode != http.StatusOK {
 		return nil, trace.Wrap(makeHTTPError(resp))
@@ -152,18 +164,24 @@ func (this *APIClient) RequestNewSession(
 	if err = decoder.Decode(session); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	this.OwnerToken = session.OwnerToken
 	return session, nil
 }
 
-func (this *APIClient) PublishSessionID(sid session.ID) error {
-	resp, err := this.POST("/api/session/"+this.SessionID,
+// PublishSessionID tells the server which Teleport session parties joining
+// via the given web session ID should connect to
+func (this *APIClient) PublishSessionID(ctx context.Context, wsid string, sid session.ID) error {
+	resp, err := this.POST(ctx, "/api/session/"+wsid,
 		"text/plain", strings.NewReader(sid.String()))
+	if err != nil {
+		return trace.Wrap(err)
+	}
 	defer resp.Body.Close()
 	// HTTP error:
 	if resp.StatusCode != http.StatusOK {
 		return trace.Wrap(makeHTTPError(resp))
 	}
-	return err
+	return nil
 }
 
 // GetSessionDetails requests the session details (keys) for a given session
@@ -172,15 +190,29 @@ func (this *APIClient) PublishSessionID(sid session.ID) error {
 //
 // If a session requres a key, a client won't receive them here, he will have
 // to use his own from ~/.ssh
-func (this *APIClient) GetSessionDetails(wsid string) (*lib.Session, error) {
-	resp, err := this.GET("/api/sessions/" + wsid)
+//
+// PIN-protected sessions require the PIN, PINError is returned if it's not
+// set or wrong
+func (this *APIClient) GetSessionDetails(ctx context.Context, wsid string) (*lib.Session, error) {
+	req, err := this.newRequest(ctx, "GET", "/api/sessions/"+wsid, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, err := this.httpClient.Do(req)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	defer resp.Body.Close()
 	// HTTP error:
 	if resp.StatusCode != http.StatusOK {
-		return nil, trace.Wrap(makeHTTPError(resp))
+		err = makeHTTPError(resp)
+		if resp.StatusCode == http.StatusForbidden && resp.Header.Get(lib.PINHeader) != "" {
+			return nil, &PINError{HTTPClientError: err.(*HTTPClientError)}
+		}
+		if resp.StatusCode == http.StatusForbidden && resp.Header.Get(lib.KnockHeader) != "" {
+			return nil, &KnockError{HTTPClientError: err.(*HTTPClientError)}
+		}
+		return nil, trace.Wrap(err)
 	}
 	var s lib.Session
 	decoder := json.NewDecoder(resp.Body)
@@ -190,9 +222,9 @@ func (this *APIClient) GetSessionDetails(wsid string) (*lib.Session, error) {
 	return &s, nil
 }
 
-func (this *APIClient) GetSessionStats(wsid string) (*lib.SessionStats, error) {
+func (this *APIClient) GetSessionStats(ctx context.Context, wsid string) (*lib.SessionStats, error) {
 	url := fmt.Sprintf("/api/sessions/%s/stats", wsid)
-	resp, err := this.GET(url)
+	resp, err := this.GET(ctx, url)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -209,25 +241,153 @@ func (this *APIClient) GetSessionStats(wsid string) (*lib.SessionStats, error) {
 	return &s, nil
 }
 
-func (this *APIClient) GET(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", this.Endpoint.String()+url, nil)
+// Knock asks the broadcaster's permission to join the session
+func (this *APIClient) Knock(ctx context.Context, wsid string, k *lib.Knock) (*lib.Knock, error) {
+	var reply lib.Knock
+	if err := this.callJSON(ctx, "POST", "/api/sessions/"+wsid+"/knocks", k, &reply); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &reply, nil
+}
+
+// GetCertNonce returns the nonce to sign a certificate request over
+func (this *APIClient) GetCertNonce(ctx context.Context, wsid string) (string, error) {
+	var reply lib.CertChallenge
+	if err := this.callJSON(ctx, "GET", "/api/sessions/"+wsid+"/certs", nil, &reply); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return reply.Nonce, nil
+}
+
+// RequestCert asks for a certificate to join the session with, in exchange
+// for an OpenSSH certificate signed by a CA the broadcaster trusts
+func (this *APIClient) RequestCert(ctx context.Context, wsid string, cr *lib.CertRequest) (*lib.CertReply, error) {
+	var reply lib.CertReply
+	if err := this.callJSON(ctx, "POST", "/api/sessions/"+wsid+"/certs", cr, &reply); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &reply, nil
+}
+
+// GetKnock returns the knock with the broadcaster's decision (if any)
+func (this *APIClient) GetKnock(ctx context.Context, wsid, kid string) (*lib.Knock, error) {
+	var reply lib.Knock
+	if err := this.callJSON(ctx, "GET", "/api/sessions/"+wsid+"/knocks/"+kid, nil, &reply); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &reply, nil
+}
+
+// GetPendingKnocks returns the knocks waiting for our decision. Only
+// the broadcaster can call it
+func (this *APIClient) GetPendingKnocks(ctx context.Context, wsid string) ([]lib.Knock, error) {
+	var knocks []lib.Knock
+	if err := this.callJSON(ctx, "GET", "/api/sessions/"+wsid+"/knocks", nil, &knocks); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return knocks, nil
+}
+
+// DecideKnock approves or denies a knock. Only the broadcaster can call it
+func (this *APIClient) DecideKnock(ctx context.Context, wsid, kid string, approved bool) error {
+	return trace.Wrap(this.callJSON(ctx, "PUT", "/api/sessions/"+wsid+"/knocks/"+kid,
+		&lib.KnockDecision{Approved: approved}, nil))
+}
+
+// GetParties returns the joining parties connected to the session. Only
+// the broadcaster can call it
+func (this *APIClient) GetParties(ctx context.Context, wsid string) ([]lib.Party, error) {
+	var parties []lib.Party
+	if err := this.callJSON(ctx, "GET", "/api/sessions/"+wsid+"/parties", nil, &parties); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return parties, nil
+}
+
+// KickParty disconnects a joining party and bars them from joining again.
+// Only the broadcaster can call it
+func (this *APIClient) KickParty(ctx context.Context, wsid, pid string) error {
+	return trace.Wrap(this.callJSON(ctx, "DELETE", "/api/sessions/"+wsid+"/parties/"+pid, nil, nil))
+}
+
+// EndSession tells the server the broadcast has ended. Only the
+// broadcaster can call it
+func (this *APIClient) EndSession(ctx context.Context, wsid string) error {
+	return trace.Wrap(this.callJSON(ctx, "DELETE", "/api/sessions/"+wsid, nil, nil))
+}
+
+// callJSON makes an API call with a JSON body (if any) and decodes the
+// JSON reply into 'out' (if given)
+func (this *APIClient) callJSON(ctx context.Context, method, url string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := this.newRequest(ctx, method, url, body)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return trace.Wrap(makeHTTPError(resp))
+	}
+	if out == nil {
+		return nil
+	}
+	return trace.Wrap(json.NewDecoder(resp.Body).Decode(out))
+}
+
+func (this *APIClient) GET(ctx context.Context, url string) (*http.Response, error) {
+	req, err := this.newRequest(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	// set the version of the client:
-	req.Header.Set(lib.ClientVersionHeader, this.clientVersion)
 	return this.httpClient.Do(req)
 }
 
-func (this *APIClient) POST(url string, contentType string, reader io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("POST", this.Endpoint.String()+url, reader)
+func (this *APIClient) POST(ctx context.Context, url string, contentType string, reader io.Reader) (*http.Response, error) {
+	req, err := this.newRequest(ctx, "POST", url, reader)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", contentType)
+	return this.httpClient.Do(req)
+}
+
+// newRequest creates an API request to the given URL (relative to the endpoint)
+func (this *APIClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, this.Endpoint.String()+url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 	// set the version of the client:
 	req.Header.Set(lib.ClientVersionHeader, this.clientVersion)
-	return this.httpClient.Do(req)
+	if this.OwnerToken != "" {
+		req.Header.Set(lib.OwnerTokenHeader, this.OwnerToken)
+	}
+	if this.Name != "" {
+		req.Header.Set(lib.NameHeader, this.Name)
+	}
+	// joining parties prove they may join:
+	if this.PIN != "" {
+		req.Header.Set(lib.PINHeader, this.PIN)
+	}
+	if this.KnockID != "" {
+		req.Header.Set(lib.KnockHeader, this.KnockID)
+	}
+	return req, nil
 }
 
 // friendlyProxyURL returns the URL of the Teleport proxy, it's the one
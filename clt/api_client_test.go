@@ -0,0 +1,146 @@
+package clt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleconsole/clt/clttest"
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/trace"
+)
+
+func TestCheckVersionRedirect(t *testing.T) {
+	busy, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Close()
+
+	busy.Script("GET", "/api/version", clttest.Redirect(free.URL))
+	free.Script("GET", "/api/version",
+		clttest.JSON(http.StatusOK, lib.ServerVersion{ServerVersion: "1.0", WarningMsg: "upgrade!"}))
+
+	api := NewAPIClient(busy.Config(), "0.0.1")
+	if err = api.CheckVersion(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if api.Endpoint.String() != free.URL {
+		t.Fatalf("client did not follow the redirect: %v", api.Endpoint)
+	}
+	reqs := free.RequestsTo("GET", "/api/version")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 version request, got %d", len(reqs))
+	}
+	if v := reqs[0].Header.Get(lib.ClientVersionHeader); v != "0.0.1" {
+		t.Fatalf("client version header is '%s'", v)
+	}
+}
+
+func TestCheckVersionTooManyRedirects(t *testing.T) {
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for i := 0; i < 3; i++ {
+		srv.Script("GET", "/api/version", clttest.Redirect(srv.URL))
+	}
+	api := NewAPIClient(srv.Config(), "0.0.1")
+	err = api.CheckVersion(context.Background())
+	httpErr, ok := trace.Unwrap(err).(*HTTPClientError)
+	if !ok {
+		t.Fatalf("expected HTTP error, got %v", err)
+	}
+	if httpErr.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %v", httpErr.Status)
+	}
+	if len(srv.RequestsTo("GET", "/api/version")) != 3 {
+		t.Fatalf("client must give up after 3 attempts")
+	}
+	srv.Script("GET", "/api/version", clttest.Redirect(""))
+	if err = api.CheckVersion(context.Background()); err == nil {
+		t.Fatalf("empty redirect must fail")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	api := NewAPIClient(srv.Config(), "0.0.1")
+
+	srv.Script("GET", "/api/sessions/one", clttest.Error(http.StatusNotFound, "no such session"))
+	srv.Script("GET", "/api/sessions/two", clttest.Text(http.StatusInternalServerError, "boom"))
+	srv.Script("GET", "/api/sessions/three/stats", clttest.Error(http.StatusForbidden, "go away"))
+
+	var testCases = []struct {
+		call    func() error
+		status  int
+		message string
+	}{
+		{func() error { _, err := api.GetSessionDetails(context.Background(), "one"); return err }, 404, "no such session"},
+		{func() error { _, err := api.GetSessionDetails(context.Background(), "two"); return err }, 500, "boom"},
+		{func() error { _, err := api.GetSessionStats(context.Background(), "three"); return err }, 403, "go away"},
+	}
+	for i, tc := range testCases {
+		httpErr, ok := trace.Unwrap(tc.call()).(*HTTPClientError)
+		if !ok {
+			t.Fatalf("case %d: expected HTTP error", i)
+		}
+		if httpErr.StatusCode != tc.status || httpErr.Message != tc.message {
+			t.Fatalf("case %d: unexpected error %v (%d)", i, httpErr, httpErr.StatusCode)
+		}
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK}
+	if makeHTTPError(resp) != nil {
+		t.Fatalf("200 is not an error")
+	}
+}
+
+func TestStuckServer(t *testing.T) {
+	stuck := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer srv.Close()
+	defer close(stuck)
+
+	c := &conf.Config{APITimeout: time.Millisecond * 200}
+	if err := c.SetEndpointHost(srv.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	c.APIEndpointURL.Scheme = "http"
+	api := NewAPIClient(c, "0.0.1")
+
+	// requests time out:
+	start := time.Now()
+	if _, err := api.GetSessionStats(context.Background(), "one"); err == nil {
+		t.Fatal("stuck server must time out")
+	}
+	if time.Since(start) > time.Second*5 {
+		t.Fatalf("request has taken %v", time.Since(start))
+	}
+	// and they can be cancelled:
+	c.APITimeout = time.Minute
+	api = NewAPIClient(c, "0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*200, cancel)
+	if _, err := api.GetSessionStats(ctx, "one"); err == nil {
+		t.Fatal("cancelled request must fail")
+	}
+	if time.Since(start) > time.Second*10 {
+		t.Fatalf("requests have taken %v", time.Since(start))
+	}
+}
@@ -0,0 +1,155 @@
+package clt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleport/integration"
+	"github.com/gravitational/teleport/lib/client"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// certSuffix is how OpenSSH names the certificate of "key": "key-cert.pub"
+const certSuffix = "-cert.pub"
+
+// userCert is an OpenSSH certificate we may join with
+type userCert struct {
+	cert *ssh.Certificate
+	// from is where the certificate is kept, for humans
+	from string
+	// signer signs with the certified key. It's loaded only if the
+	// certificate is usable, so nobody is asked for passphrases in vain
+	signer func() (ssh.Signer, error)
+}
+
+// certifiedUserFor finds an OpenSSH certificate signed by one of the CAs
+// the broadcaster trusts and trades it for the session user with a
+// certificate for our key. The certificate comes from the identity file
+// ("key-cert.pub" next to it), ssh-agent or ~/.ssh
+func certifiedUserFor(ctx context.Context, out io.Writer, api *APIClient, session *lib.Session, fp string, keys *lib.Agent) (*integration.User, ssh.Signer, error) {
+	now := time.Now()
+	for _, uc := range userCerts(fp, keys) {
+		if !trustedCert(session, uc.cert, now) {
+			continue
+		}
+		signer, err := uc.signer()
+		if err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+		nonce, err := api.GetCertNonce(ctx, session.ID)
+		if err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+		var req lib.CertRequest
+		if err = req.Sign(session.ID, nonce, uc.cert, signer); err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+		reply, err := api.RequestCert(ctx, session.ID, &req)
+		if err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+		fmt.Fprintf(out, "Matching certificate: %s (%s)\n", uc.from, uc.cert.KeyId)
+		return &integration.User{
+			Username:      reply.Username,
+			AllowedLogins: reply.AllowedLogins,
+			Key: &client.Key{
+				Pub:  ssh.MarshalAuthorizedKey(uc.cert.Key),
+				Cert: []byte(reply.Cert),
+			},
+		}, lib.CertifiedSigner(uc.cert, signer), nil
+	}
+	return nil, nil, trace.Errorf("\nTo join this session you must provide a valid SSH key or certificate.\n"+
+		"No matching keys or certificates signed by the CAs the broadcaster trusts were found\n"+
+		"in ssh-agent or on your machine in ~/.ssh\n"+
+		"Try specifying an SSH key with a certificate (id_rsa-cert.pub) with -i flag, for example:\n\n"+
+		"> teleconsole -i ./id_rsa join %s\n", session.ID)
+}
+
+// trustedCert returns true if one of the CAs of the session accepts the
+// certificate
+func trustedCert(session *lib.Session, cert *ssh.Certificate, now time.Time) bool {
+	for _, ca := range session.TrustedCAs {
+		err := ca.Check(cert, now)
+		if err == nil {
+			return true
+		}
+		log.Debugf("certificate %q: %v", cert.KeyId, err)
+	}
+	return false
+}
+
+// userCerts returns the OpenSSH certificates of the identity file (if
+// given) or the ones held by ssh-agent and kept in ~/.ssh
+func userCerts(fp string, keys *lib.Agent) (certs []userCert) {
+	if fp != "" {
+		if uc := userCertFor(fp); uc != nil {
+			certs = append(certs, *uc)
+		}
+		return certs
+	}
+	if keys != nil {
+		signers, err := keys.Signers()
+		if err != nil {
+			log.Debug(err)
+		}
+		for _, s := range signers {
+			if cert, ok := s.PublicKey().(*ssh.Certificate); ok {
+				signer := s
+				certs = append(certs, userCert{
+					cert:   cert,
+					from:   "ssh-agent",
+					signer: func() (ssh.Signer, error) { return signer, nil },
+				})
+			}
+		}
+	}
+	me, err := user.Current()
+	if err != nil {
+		log.Debug(err)
+		return certs
+	}
+	files, _ := filepath.Glob(filepath.Join(me.HomeDir, ".ssh", "id_*"+certSuffix))
+	for _, f := range files {
+		if uc := userCertFor(strings.TrimSuffix(f, certSuffix)); uc != nil {
+			certs = append(certs, *uc)
+		}
+	}
+	return certs
+}
+
+// userCertFor returns the certificate of the private key in the file, or
+// nil if there's none
+func userCertFor(fp string) *userCert {
+	data, err := ioutil.ReadFile(fp + certSuffix)
+	if err != nil {
+		log.Debug(err)
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		log.Debugf("%s: %v", fp+certSuffix, err)
+		return nil
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil
+	}
+	return &userCert{
+		cert: cert,
+		from: fp + certSuffix,
+		signer: func() (ssh.Signer, error) {
+			_, signer, err := lib.ReadPrivateKey(fp)
+			return signer, trace.Wrap(err)
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package clt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// dataDirMarker is the file in the local Teleport instance's data
+	// directory which tells which process it belongs to
+	dataDirMarker = "teleconsole.pid"
+
+	// staleDataDirAge is the age of unmarked data directories which are
+	// considered left behind
+	staleDataDirAge = time.Hour * 24
+
+	// keysDirPrefix starts the names of joining parties' key directories
+	keysDirPrefix = "teleconsole-keys-"
+
+	// endSessionTimeout limits how long we tell the server the session
+	// has ended
+	endSessionTimeout = time.Second * 5
+)
+
+// markDataDir records our PID in the data directory of the local Teleport
+// instance, so it could be swept if we crash
+func markDataDir(dir string) error {
+	pid := strconv.Itoa(os.Getpid())
+	return trace.Wrap(ioutil.WriteFile(filepath.Join(dir, dataDirMarker), []byte(pid), 0600))
+}
+
+// makeKeysDir creates a private directory for the keys of a joining party.
+// The caller must remove it when the session ends
+func makeKeysDir() (string, error) {
+	dir, err := ioutil.TempDir("", keysDirPrefix)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	// TempDir creates it with 0700, but make sure nobody else can look in:
+	if err = os.Chmod(dir, 0700); err == nil {
+		err = markDataDir(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", trace.Wrap(err)
+	}
+	return dir, nil
+}
+
+// sweepDataDirs deletes the data directories of local Teleport instances
+// and the key directories in 'tmpDir' left behind by teleconsole processes
+// which are gone
+func sweepDataDirs(tmpDir string) {
+	var dirs []string
+	for _, pattern := range []string{"cluster-" + DefaultSiteName + "*", keysDirPrefix + "*"} {
+		matches, err := filepath.Glob(filepath.Join(tmpDir, pattern))
+		if err != nil {
+			log.Warning(err)
+			return
+		}
+		dirs = append(dirs, matches...)
+	}
+	for _, dir := range dirs {
+		if !isStaleDataDir(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warningf("failed deleting stale session data %v: %v", dir, err)
+			continue
+		}
+		log.Infof("deleted stale session data %v", dir)
+	}
+}
+
+// isStaleDataDir returns true if the process which has created the data
+// directory is gone
+func isStaleDataDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, dataDirMarker))
+	if err != nil {
+		// unmarked directories are being set up or are really old:
+		return time.Since(fi.ModTime()) > staleDataDirAge
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return true
+	}
+	return !processExists(pid)
+}
+
+// processExists returns true if there's a process with the given PID
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// endSession tells the server the broadcast has ended, so it could shut
+// the disposable proxy down right away
+func endSession(api *APIClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), endSessionTimeout)
+	defer cancel()
+	if err := api.EndSession(ctx, api.SessionID); err != nil {
+		log.Debugf("failed to end the session on the server: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package clt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepDataDirs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	mkdir := func(name string) string {
+		dir := filepath.Join(tmp, name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	// ours:
+	alive := mkdir("cluster-" + DefaultSiteName + "1")
+	if err = markDataDir(alive); err != nil {
+		t.Fatal(err)
+	}
+	// left by a crashed process:
+	dead := mkdir("cluster-" + DefaultSiteName + "2")
+	ioutil.WriteFile(filepath.Join(dead, dataDirMarker), []byte("999999999"), 0600)
+	// unmarked, just created and long forgotten:
+	fresh := mkdir("cluster-" + DefaultSiteName + "3")
+	old := mkdir("cluster-" + DefaultSiteName + "4")
+	longAgo := time.Now().Add(-staleDataDirAge * 2)
+	os.Chtimes(old, longAgo, longAgo)
+	// joining party's keys left behind:
+	keys := mkdir(keysDirPrefix + "1")
+	ioutil.WriteFile(filepath.Join(keys, dataDirMarker), []byte("999999999"), 0600)
+	// not ours at all:
+	other := mkdir("cluster-something-else")
+	ioutil.WriteFile(filepath.Join(other, dataDirMarker), []byte("999999999"), 0600)
+
+	sweepDataDirs(tmp)
+	for dir, kept := range map[string]bool{alive: true, dead: false, fresh: true, old: false, keys: false, other: true} {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Fatalf("%v: expected kept=%v, got %v", dir, kept, err)
+		}
+	}
+}
+
+func TestMakeKeysDir(t *testing.T) {
+	dir, err := makeKeysDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Fatalf("keys directory must be private, got %v", fi.Mode())
+	}
+	if isStaleDataDir(dir) {
+		t.Fatal("keys directory of a running process must not be swept")
+	}
+	// every join gets its own:
+	other, err := makeKeysDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+	if other == dir {
+		t.Fatal("concurrent joins must not share keys directories")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,6 +26,7 @@ import (
 
 	tsession "github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -36,21 +39,36 @@ var (
 	SyncRefreshInterval = time.Second
 )
 
+// maxPINAttempts is how many times a joining party is asked for the PIN
+const maxPINAttempts = 3
+
+// ExitError is returned by StartBroadcast when the command given via -c
+// exits with a non-zero status
+type ExitError struct {
+	Code int
+}
+
+func (this *ExitError) Error() string {
+	return fmt.Sprintf("Command exited with status %d", this.Code)
+}
+
 // StartBroadcast starts a new SSH session exposed to the world via disposable
 // SSH proxy.
 //
 // This function:
 //
-// 1. Generates a new SSH keypair and creates a temporary SSH server which
-//    trusts this pair.
-// 2. Sends the credentials via HTTPS to a Teleconsole server, which will create
-//    a single-use, single-tentant (just for us) SSH proxy
-// 3. Receives an ID of the server-side proxy session. That ID can be shared
-//    with other Teleconsole users so they could join this SSH session via proxy
-// 4. Launches shell. When the shell exits, the SSH session is also terminated
-//    disconnecting all parties.
-func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
+//  1. Generates a new SSH keypair and creates a temporary SSH server which
+//     trusts this pair.
+//  2. Sends the credentials via HTTPS to a Teleconsole server, which will create
+//     a single-use, single-tentant (just for us) SSH proxy
+//  3. Receives an ID of the server-side proxy session. That ID can be shared
+//     with other Teleconsole users so they could join this SSH session via proxy
+//  4. Launches shell. When the shell exits, the SSH session is also terminated
+//     disconnecting all parties. If a command was given via -c, the shell
+//     is replaced with it and the session ends when the command exits.
+func StartBroadcast(ctx context.Context, c *conf.Config, api *APIClient) error {
 	hostName := "localhost"
+	out := c.GetMessageOut()
 	var (
 		me, them *lib.Identity
 		err      error
@@ -58,10 +76,24 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	if c.ForwardPorts != nil {
 		return trace.Errorf("-L must be used with join")
 	}
+	if len(c.RemoteForwards) > 0 {
+		return trace.Errorf("-R must be used with join")
+	}
+	if len(c.DynamicForwards) > 0 {
+		return trace.Errorf("-D must be used with join")
+	}
+	if (c.PINProtected || c.PIN != "") && c.IdentityFile != "" {
+		return trace.Errorf("-pin cannot be used with -i: key-restricted sessions do not share keys")
+	}
 	// check API connectivity and compatibility
-	if err = api.CheckVersion(); err != nil {
+	if err = api.CheckVersion(ctx); err != nil {
 		return trace.Wrap(err)
 	}
+	if c.PINProtected && c.PIN == "" {
+		if c.PIN, err = askNewPIN(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
 	// create the anonymous local user identity for logging into ourselves
 	me, err = lib.MakeIdentity("")
 	if err != nil {
@@ -71,6 +103,7 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	// no identity was specified via -i flag, use the
 	// generated anonymous one from above
 	if c.IdentityFile != "" {
+		lib.ConfigureGithub(c.GithubAPI, c.GithubToken)
 		them, err = lib.MakeIdentity(c.IdentityFile)
 		if err != nil {
 			return trace.Wrap(err)
@@ -78,15 +111,42 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	} else {
 		them = me
 	}
+	// clean up after the broadcasts which have crashed:
+	sweepDataDirs(os.TempDir())
+
 	// pre-allocate a few open ports for launching an SSH server
 	ports, err := lib.GetFreePorts(5)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 	// create a new (local) teleport server instance and add ourselves as a user to it:
-	fmt.Printf("Starting local SSH server on %s...\n", hostName)
+	fmt.Fprintf(out, "Starting local SSH server on %s...\n", hostName)
 	localServer := integration.NewInstance(DefaultSiteName, hostName, ports, nil, nil)
-	localServer.Secrets.Users = them.AnnounceUsers()
+	// PIN-protected sessions announce the keys sealed with the PIN:
+	announced := them.AnnounceUsers()
+	// read-only observers log in as users of their own:
+	if c.Observers {
+		observerUsers, err := them.ObserverUsers()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		for name, u := range observerUsers {
+			announced[name] = u
+		}
+	}
+	var pinVerifier string
+	if c.PIN != "" {
+		if err = lib.CheckPINStrength(c.PIN); err != nil {
+			return trace.Wrap(err)
+		}
+		if err = announced.Seal(c.PIN); err != nil {
+			return trace.Wrap(err)
+		}
+		if pinVerifier, err = lib.MakePINVerifier(c.PIN); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	localServer.Secrets.Users = announced
 
 	// request Teleconsole server to create a remote teleport proxy we can
 	// broadcast our connection through:
@@ -94,12 +154,71 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	if !them.Anonymous {
 		guestName = c.IdentityFile
 	}
-	fmt.Printf("Requesting a disposable SSH proxy on %s for %s...\n", c.GetEndpointHost(), guestName)
-	ourHostPort := net.JoinHostPort(localServer.Hostname, localServer.GetPortSSH())
-	sess, err := api.RequestNewSession(me.Username, localServer.Secrets, ourHostPort, c.ForwardPort)
+	fmt.Fprintf(out, "Requesting a disposable SSH proxy on %s for %s...\n", c.GetEndpointHost(), guestName)
+	// keystrokes go through the console, so we could ask the broadcaster
+	// to allow remote port forwarding requested by joining parties:
+	stdout := c.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	stdin := c.Stdin
+	if stdin == nil {
+		stdin = os.Stdin
+		if lib.IsTerminal() {
+			restore, err := lib.MakeRaw()
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			defer restore()
+		}
+	}
+	console := newConsole(stdin, stdout)
+	relay, err := lib.NewRelayServer(func(f *lib.RemoteForward) bool {
+		return console.Ask(ctx, fmt.Sprintf("A joining party wants %s on your machine to lead to %s on theirs. Allow?",
+			f.BindAddr(), f.DestAddr()))
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer relay.Close()
+
+	// observers get the output of the shell from the mirror:
+	var observers *mirror
+	if c.Observers {
+		if observers, err = newMirror(hostName); err != nil {
+			return trace.Wrap(err)
+		}
+		defer observers.Close()
+	}
+
+	req := &lib.Session{
+		Secrets:        localServer.Secrets,
+		Login:          me.Username,
+		NodeHostPort:   net.JoinHostPort(localServer.Hostname, localServer.GetPortSSH()),
+		ForwardedPorts: c.PortInvites,
+		RelayAddr:      relay.Addr(),
+		PINVerifier:    pinVerifier,
+		// joining parties knock first, if we want to approve them:
+		ApprovalRequired: c.Approve,
+		TrustedCAs:       them.CAs,
+	}
+	if observers != nil {
+		req.MirrorAddr = observers.Addr()
+	}
+	// SOCKS proxy for joining parties (-socks):
+	if c.SOCKSAllowList != nil {
+		socks, err := lib.NewSOCKSServer(c.SOCKSAllowList)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		defer socks.Close()
+		req.SOCKSAddr = socks.Addr()
+	}
+	sess, err := api.RequestNewSession(ctx, req, c.Observers)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	defer endSession(api)
 
 	// Assign the proper server to the generated secrets (they'll be used to configure
 	// the reverse SSH tunnel to it)
@@ -112,7 +231,10 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	tconf.Console = nil
 	tconf.Auth.NoAudit = true
 	tconf.Proxy.DisableWebUI = true
+	// observers' users are not trusted by our SSH server: they can only
+	// log into the mirror
 	trustedSecrets := sess.Secrets
+	trustedSecrets.Users = lib.UserMap(sess.Secrets.Users).Without(lib.IsObserver)
 	for uname, user := range me.LoginUsers() {
 		trustedSecrets.Users[uname] = user
 	}
@@ -120,12 +242,20 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	if err = localServer.CreateEx(trustedSecrets.AsSlice(), tconf); err != nil {
 		return trace.Wrap(err)
 	}
+	// the local instance keeps the keys in its data dir, it must not
+	// outlive the broadcast. This will also close the proxied connection:
+	var stopOnce sync.Once
+	stopLocalServer := func() {
+		stopOnce.Do(func() { onStopBroadcast(localServer) })
+	}
+	defer stopLocalServer()
+	if err = markDataDir(localServer.Config.DataDir); err != nil {
+		log.Warning(err)
+	}
 	log.Debugf("client config: %v\n", localServer.Config.DebugDumpToYAML())
 	if err = localServer.Start(); err != nil {
 		return trace.Wrap(err)
 	}
-	// this will close the proxied connection:
-	defer onStopBroadcast(localServer)
 
 	// create a local client to "SSH into ourselves":
 	port, _ := strconv.Atoi(localServer.GetPortSSH())
@@ -133,49 +263,173 @@ func StartBroadcast(c *conf.Config, api *APIClient, cmd []string) error {
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	setStdio(c, &sshClient.Config)
+	sshClient.Stdin = console
+	// observers and the recording receive a copy of everything we see:
+	outputs := []io.Writer{stdout}
+	if observers != nil {
+		if err = startMirror(observers, localServer, sess); err != nil {
+			return trace.Wrap(err)
+		}
+		outputs = append(outputs, observers)
+	}
+	if c.RecordFile != "" {
+		rec, err := startRecording(c.RecordFile)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				fmt.Fprintf(out, "Failed to record the session to %s: %v\n", c.RecordFile, err)
+				return
+			}
+			fmt.Fprintf(out, "The session has been recorded to %s\n", c.RecordFile)
+		}()
+		outputs = append(outputs, rec)
+	}
+	sshClient.Stdout = io.MultiWriter(outputs...)
+	// background watchers stop when the broadcast ends, nothing is reported
+	// after it has ended:
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	var watchers background
+	defer watchers.Wait()
+	defer stopWatching()
+	// cancelled broadcasts (e.g. by a signal) are torn down right away:
+	go func() {
+		<-watchCtx.Done()
+		if ctx.Err() != nil {
+			stopLocalServer()
+		}
+	}()
+	notifier := &partyNotifier{mode: c.Notify, out: stdout, console: console}
+	defer notifier.clear()
+	events := newEventWriter(c)
 	// Define "shell created" callback
 	sshClient.OnShellCreated = func(shell io.ReadWriteCloser) (exit bool, err error) {
+		// the broadcast must get through to the server in time:
+		setupCtx, cancel := context.WithTimeout(ctx, c.GetSetupTimeout())
+		defer cancel()
 		// publish the session (when it's ready) so the server-side disposable
 		// proxy will locate this client by a session ID
-		if err = publishSession(localServer, api); err != nil {
+		if err := publishSession(setupCtx, localServer, api, api.SessionID); err != nil {
 			log.Error(err)
 			return true, err
 		}
 		// now lets see how many clients the server sees (should be at 1 - ourselves)
-		fmt.Println("Checking status of the SSH tunnel...")
+		fmt.Fprintln(out, "Checking status of the SSH tunnel...")
 		var brokenSessionError = fmt.Errorf("SSH tunnel cannot be established, please try again.")
 		const attempts = 10
 		for i := 0; i < attempts; i++ {
-			time.Sleep(SyncRefreshInterval)
-			sessionStats, err := api.GetSessionStats(api.SessionID)
+			select {
+			case <-time.After(SyncRefreshInterval):
+			case <-setupCtx.Done():
+				return true, trace.ConnectionProblem(setupCtx.Err(), "SSH tunnel is not established in time")
+			}
+			sessionStats, err := api.GetSessionStats(setupCtx, api.SessionID)
 			if err != nil {
 				log.Debug(err)
 				return true, brokenSessionError
 			}
 			// found ourserlves!
 			if len(sessionStats.Parties) > 0 {
-				fmt.Printf("\n\rYour Teleconsole ID: \033[1m%s%s\033[0m\n\r", geo.SesionPrefixFor(c.GetEndpointHost()), api.SessionID)
+				created := lib.Event{
+					Type:      lib.EventSessionCreated,
+					SessionID: geo.SesionPrefixFor(c.GetEndpointHost()) + api.SessionID,
+				}
+				fmt.Fprintf(out, "\n\rYour Teleconsole ID: \033[1m%s\033[0m\n\r", created.SessionID)
 				if them.Anonymous {
-					fmt.Printf("WebUI for this session: %v/s/%s\n\rTo stop broadcasting, exit current shell by typing 'exit' or closing the window.\n\r",
-						api.friendlyProxyURL(), api.SessionID)
+					created.WebURL = fmt.Sprintf("%v/s/%s", api.friendlyProxyURL(), api.SessionID)
+					fmt.Fprintf(out, "WebUI for this session: %v\n\rTo stop broadcasting, exit current shell by typing 'exit' or closing the window.\n\r",
+						created.WebURL)
 				} else {
-					fmt.Printf("WebUI is not available for key-restricted sessions\n\r")
+					fmt.Fprintf(out, "WebUI is not available for key-restricted sessions\n\r")
+				}
+				if c.SOCKSAllowList != nil {
+					fmt.Fprintf(out, "Joining parties may use your machine as a SOCKS proxy to reach: %s\n\r"+
+						"(this does not stop them from reaching anything else with -L)\n\r",
+						socksDestinations(c.SOCKSAllowList))
 				}
+				console.OnMenu(func() { partyMenu(watchCtx, api, console) })
+				if c.Notify != NotifyNone || events != nil {
+					watcher := newPartyWatcher(api, func(p lib.Party) {
+						notifier.joined(p)
+						events.partyJoined(p)
+					}, func(p lib.Party) {
+						notifier.left(p)
+						events.partyLeft(p)
+					})
+					watchers.Go(func() { watcher.run(watchCtx, SyncRefreshInterval*2) })
+				}
+				fmt.Fprintf(out, "Press Ctrl-] to see who has joined or to kick someone out.\n\r")
+				if c.Approve {
+					fmt.Fprintf(out, "You will be asked to let in every joining party\n\r")
+					watchers.Go(func() { watchKnocks(watchCtx, api, console) })
+				}
+				if observers != nil {
+					created.ObserverID = geo.SesionPrefixFor(c.GetEndpointHost()) + api.ObserverID
+					fmt.Fprintf(out, "Read-only Teleconsole ID for observers: \033[1m%s\033[0m\n\r", created.ObserverID)
+				}
+				events.Emit(created)
+				// the broadcast ends when the caller cancels it:
+				go func() {
+					<-watchCtx.Done()
+					shell.Close()
+				}()
 				return false, nil
 			}
 		}
 		return true, brokenSessionError
 	}
+	// the session runs the requested command instead of a shell, in a
+	// terminal of its own. It's run by sh, whatever our login shell is:
+	var command []string
+	if c.RunCommand != "" {
+		command = []string{"sh", "-c", shellQuote(c.RunCommand)}
+		sshClient.Interactive = true
+	}
 	// SSH into ourselves (we'll try a few times)
-	err = sshClient.SSH(context.TODO(), cmd, false)
+	err = sshClient.SSH(ctx, command, false)
+	stopWatching()
+	watchers.Wait()
+	events.ended(geo.SesionPrefixFor(c.GetEndpointHost())+api.SessionID, err)
+	if c.RunCommand != "" {
+		if code, ok := exitStatus(err); ok {
+			fmt.Fprintln(out, "The command has exited and the SSH tunnel is closed.")
+			if code != 0 {
+				return &ExitError{Code: code}
+			}
+			return nil
+		}
+	}
 	if err != nil {
 		return trace.Wrap(err)
 	} else {
-		fmt.Println("You have ended your session broadcast and the SSH tunnel is closed.")
+		fmt.Fprintln(out, "You have ended your session broadcast and the SSH tunnel is closed.")
 	}
 	return nil
 }
 
+// exitStatus extracts the exit status of a remote command from the error
+// returned by the SSH client. Returns false if the error is not about
+// the exit status
+func exitStatus(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	// SSH library may be vendored by Teleport, so don't check for the type:
+	if exitErr, ok := trace.Unwrap(err).(interface {
+		ExitStatus() int
+	}); ok {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// shellQuote quotes a string so POSIX shell would treat it as a single word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 // onStopBroadcast is called when the broadcasted session ends
 func onStopBroadcast(local *integration.TeleInstance) {
 	local.Stop(true)
@@ -187,10 +441,10 @@ func onStopBroadcast(local *integration.TeleInstance) {
 	log.Infof("Deleted session log at %s", local.Config.DataDir)
 }
 
-// publishSession must run as a goroutine: it waits for the local session
-// inside 'local' Teleport instance to become available, and as soon as it
-// does, it publishes it to the Telecast servers' disposable proxy
-func publishSession(local *integration.TeleInstance, api *APIClient) error {
+// publishSession waits for a new session inside 'local' Teleport instance
+// to become available, and as soon as it does, it publishes it to the
+// Telecast servers' disposable proxy under the given web session ID
+func publishSession(ctx context.Context, local *integration.TeleInstance, api *APIClient, wsid string) error {
 	// make sure the tunnel ("site API") is initialized:
 	if local.Tunnel == nil {
 		return trace.Wrap(tunnelError)
@@ -207,34 +461,55 @@ func publishSession(local *integration.TeleInstance, api *APIClient) error {
 	}
 	// poll for the session ID:
 	for {
-		time.Sleep(time.Millisecond * 100)
+		select {
+		case <-time.After(time.Millisecond * 100):
+		case <-ctx.Done():
+			return trace.ConnectionProblem(ctx.Err(), "the session has not started in time")
+		}
 		sessions, err := siteAPI.GetSessions(defaults.Namespace)
 		if err != nil {
 			continue
 		}
-		if len(sessions) == 0 {
-			continue
-		}
-		err = api.PublishSessionID(sessions[0].ID)
-		if err != nil {
-			log.Error("failed to publish to Teleconsole server: ", err)
-			local.Stop(true)
+		for _, s := range sessions {
+			if err = api.PublishSessionID(ctx, wsid, s.ID); err != nil {
+				log.Error("failed to publish to Teleconsole server: ", err)
+				local.Stop(true)
+				return trace.Wrap(err)
+			}
+			// success:
+			return nil
 		}
-		// success:
-		break
 	}
-	return nil
 }
 
-func printPortInvite(login string, p *client.ForwardedPort) {
+// startMirror lets observers into the mirror: it is known by a host
+// certificate of our SSH server's CA and accepts observers' certificates
+// issued by the proxy
+func startMirror(m *mirror, local *integration.TeleInstance, sess *lib.Session) error {
+	hostCA, err := ssh.ParsePrivateKey(local.Secrets.PrivKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	userCA, _, _, _, err := ssh.ParseAuthorizedKey(sess.Secrets.PubKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(m.Start(hostCA, userCA))
+}
+
+func printPortInvite(out io.Writer, login string, p *lib.PortInvite) {
 	friendlySrc := func() string {
+		host := "localhost"
+		if p.SrcIP != "" && p.SrcIP != "127.0.0.1" {
+			host = p.SrcIP
+		}
 		if p.DestPort == 80 {
-			return fmt.Sprintf("http://localhost:%v", p.SrcPort)
+			return fmt.Sprintf("http://%s:%v", host, p.SrcPort)
 		}
 		if p.DestPort == 443 {
-			return fmt.Sprintf("https://localhost:%v", p.SrcPort)
+			return fmt.Sprintf("https://%s:%v", host, p.SrcPort)
 		}
-		return fmt.Sprintf("localhost:%v", p.SrcPort)
+		return fmt.Sprintf("%s:%v", host, p.SrcPort)
 	}
 	friendlyDest := func() string {
 		if p.DestHost == "localhost" || p.DestHost == "127.0.0.1" {
@@ -243,63 +518,245 @@ func printPortInvite(login string, p *client.ForwardedPort) {
 		return fmt.Sprintf("%s:%v using their machine as proxy",
 			p.DestHost, p.DestPort)
 	}
-	fmt.Printf("ATTENTION: %s has invited you to access %s via %s\n",
+	label := ""
+	if p.Label != "" {
+		label = fmt.Sprintf(" (%s)", p.Label)
+	}
+	fmt.Fprintf(out, "ATTENTION: %s has invited you to access %s%s via %s\n",
 		login,
 		friendlyDest(),
+		label,
 		friendlySrc())
 }
 
+// mapPortInvites assigns local addresses to port invites according to the
+// mappings, picking free ports on 127.0.0.1 for the rest
+func mapPortInvites(out io.Writer, invites []*lib.PortInvite, mappings []*lib.PortMapping) error {
+	for _, m := range mappings {
+		found := false
+		for _, invite := range invites {
+			if invite.SrcPort == 0 && invite.Matches(m.Invite) {
+				invite.SrcIP, invite.SrcPort = m.SrcIP, m.SrcPort
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(out, "WARNING: this session has no port invite '%s'\n", m.Invite)
+		}
+	}
+	for _, invite := range invites {
+		if invite.SrcPort != 0 {
+			continue
+		}
+		ports, err := lib.GetFreePorts(1)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		invite.SrcIP, invite.SrcPort = "127.0.0.1", ports[0]
+	}
+	return nil
+}
+
 // Joins someone's session given its ID
-func Join(c *conf.Config, api *APIClient, sid string) error {
-	if c.ForwardPort != nil {
+func Join(ctx context.Context, c *conf.Config, api *APIClient, sid string) error {
+	out := c.GetMessageOut()
+	if len(c.PortInvites) > 0 {
 		return trace.Errorf("-f cannot be used with join")
 	}
+	if c.SOCKSAllowList != nil {
+		return trace.Errorf("-socks cannot be used with join")
+	}
+	if c.RunCommand != "" {
+		return trace.Errorf("-c cannot be used with join")
+	}
+	if c.RecordFile != "" {
+		return trace.Errorf("-record cannot be used with join")
+	}
 	red := color.New(color.FgHiBlue).SprintFunc()
-	fmt.Printf("%s joining session...\n\r", red("Teleconsole:"))
+	fmt.Fprintf(out, "%s joining session...\n\r", red("Teleconsole:"))
+
+	// introduce ourselves to the broadcaster:
+	if c.Name == "" {
+		c.Name = announcedName()
+	}
+	api.Name = c.Name
+
+	// keys held by ssh-agent can prove who we are without being read:
+	keys, err := lib.ConnectAgent()
+	if err != nil {
+		log.Debug(err)
+	} else {
+		defer keys.Close()
+	}
 
-	// request credentials from the proxy:
-	session, err := api.GetSessionDetails(sid)
+	// request credentials from the proxy, asking for the PIN if needed:
+	api.PIN = c.PIN
+	session, err := api.GetSessionDetails(ctx, sid)
+	for i := 0; i < maxPINAttempts; i++ {
+		// there's nobody to ask if the session is not on the terminal:
+		if _, ok := err.(*PINError); !ok || c.Stdin != nil {
+			break
+		}
+		if api.PIN != "" {
+			fmt.Fprintf(out, "%s %s\n\r", red("Teleconsole:"), err.(*PINError).Message)
+		}
+		if api.PIN, err = lib.ReadPassword("Session PIN: "); err != nil {
+			return trace.Wrap(err)
+		}
+		session, err = api.GetSessionDetails(ctx, sid)
+	}
+	// the broadcaster approves every joining party?
+	if _, ok := err.(*KnockError); ok {
+		if err = knock(ctx, c, api, sid, keys); err != nil {
+			return trace.Wrap(err)
+		}
+		session, err = api.GetSessionDetails(ctx, sid)
+	}
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	c.PIN = api.PIN
 	// session's proxy host is never configured properly (because the server
 	// who returned it does not know which DNS name it's accessible by).
 	// replace host, keep ports:
 	session.ProxyHostPort = lib.ReplaceHost(session.ProxyHostPort, api.Endpoint.Host)
 
 	// apply our identity's keys to this session
-	user, err := findUserFor(session, c.IdentityFile)
+	user, signer, err := findUserFor(out, session, c.IdentityFile, c.PIN, keys)
+	if err != nil && len(session.TrustedCAs) > 0 {
+		// the broadcaster also admits holders of certificates signed by
+		// the CAs they trust:
+		user, signer, err = certifiedUserFor(ctx, out, api, session, c.IdentityFile, keys)
+	}
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	// if this session offers a "port forwarding invite", always configure it
-	// to be accessible via 127.0.0.1:9000 (to be made configurable later)
-	if session.ForwardedPort != nil {
-		session.ForwardedPort.SrcIP = "127.0.0.1"
-		session.ForwardedPort.SrcPort = 9000
-		c.ForwardPorts = []client.ForwardedPort{*session.ForwardedPort}
-		printPortInvite(session.Login, session.ForwardedPort)
+	// observers only get to watch the broadcaster's mirror: they can't
+	// reach the broadcaster's machine (their users are not let in there)
+	if session.Observer {
+		if session.MirrorAddr == "" {
+			return trace.Errorf("this session cannot be watched")
+		}
+		if len(c.ForwardPorts) > 0 {
+			return trace.Errorf("-L is not available to observers")
+		}
+		fmt.Fprintf(out, "%s you are an observer: you will see the session, but your keystrokes will be ignored\n\r",
+			red("Teleconsole:"))
+	} else {
+		// if this session offers "port forwarding invites", always accept them,
+		// on the local ports given via -map or on free ones
+		// (legacy sessions make up a new list every time, so it's made once)
+		invites := session.GetPortInvites()
+		if err = mapPortInvites(out, invites, c.PortMappings); err != nil {
+			return trace.Wrap(err)
+		}
+		for _, invite := range invites {
+			c.ForwardPorts = append(c.ForwardPorts, invite.ForwardedPort)
+			printPortInvite(out, session.Login, invite)
+		}
+	}
+	// remote forwarding goes via the broadcaster's relay, which we reach
+	// through a (local) forwarded port:
+	var relayPort int
+	if len(c.RemoteForwards) > 0 {
+		if session.RelayAddr == "" || session.Observer {
+			return trace.Errorf("-R is not available in this session")
+		}
+		host, port, err := net.SplitHostPort(session.RelayAddr)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		ports, err := lib.GetFreePorts(1)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		relayPort = ports[0]
+		destPort, _ := strconv.Atoi(port)
+		c.ForwardPorts = append(c.ForwardPorts, client.ForwardedPort{
+			SrcIP:    "127.0.0.1",
+			SrcPort:  relayPort,
+			DestHost: host,
+			DestPort: destPort,
+		})
+	}
+	// dynamic forwarding goes to the broadcaster's SOCKS proxy:
+	if len(c.DynamicForwards) > 0 {
+		if session.SOCKSAddr == "" || session.Observer {
+			return trace.Errorf("-D is not available: the broadcaster has not enabled SOCKS proxy with -socks")
+		}
+		host, port, err := net.SplitHostPort(session.SOCKSAddr)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		destPort, _ := strconv.Atoi(port)
+		for _, addr := range c.DynamicForwards {
+			ip, p, err := net.SplitHostPort(addr)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			srcPort, _ := strconv.Atoi(p)
+			c.ForwardPorts = append(c.ForwardPorts, client.ForwardedPort{
+				SrcIP:    ip,
+				SrcPort:  srcPort,
+				DestHost: host,
+				DestPort: destPort,
+			})
+			fmt.Fprintf(out, "%s SOCKS5 proxy on %s leads through %s's machine\n\r", red("Teleconsole:"), addr, session.Login)
+		}
 	}
 	// these are target host's node/port (machine where the invite came from)
 	nodeHost, nodePort, err := session.GetNodeHostPort()
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	hostLogin := session.Login
+	if session.Observer {
+		var port string
+		if nodeHost, port, err = net.SplitHostPort(session.MirrorAddr); err != nil {
+			return trace.Wrap(err)
+		}
+		nodePort, _ = strconv.Atoi(port)
+		hostLogin = lib.ObserverLogin
+	}
+	// session keys are kept in a private directory of our own:
+	sweepDataDirs(os.TempDir())
+	keysDir, err := makeKeysDir()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer os.RemoveAll(keysDir)
+	// the agent (or our certified key) signs for the key with the session
+	// certificate:
+	var authMethods []ssh.AuthMethod
+	if signer != nil {
+		cert, _, _, _, err := ssh.ParseAuthorizedKey(user.Key.Cert)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		certSigner, err := ssh.NewCertSigner(cert.(*ssh.Certificate), signer)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(certSigner))
+	}
 	// create a new SSH client
 	tc, err := client.NewClient(&client.Config{
 		Username:           user.Username,
 		ProxyHostPort:      session.ProxyHostPort,
 		Host:               nodeHost,
 		HostPort:           nodePort,
-		HostLogin:          session.Login,
+		HostLogin:          hostLogin,
 		InsecureSkipVerify: false,
-		KeysDir:            "/tmp/",
+		KeysDir:            keysDir,
 		SiteName:           DefaultSiteName,
 		LocalForwardPorts:  c.ForwardPorts,
+		AuthMethods:        authMethods,
 	})
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	setStdio(c, &tc.Config)
 	// configure it to trust the proxy:
 	cas := session.Secrets.GetCAs()
 	for i := range cas {
@@ -309,26 +766,152 @@ func Join(c *conf.Config, api *APIClient, sid string) error {
 		}
 	}
 
-	// initialize it with the user credentials we've matched against the session:
-	tc.AddKey(nodeHost, user.Key)
+	// initialize it with the user credentials we've matched against the
+	// session (the agent's and certified keys are not ours to add):
+	if signer == nil {
+		tc.AddKey(nodeHost, user.Key)
+	}
+	// remote forwarding ends with the session:
+	forwardCtx, stopForwarding := context.WithCancel(ctx)
+	defer stopForwarding()
+	for _, f := range c.RemoteForwards {
+		go runRemoteForward(forwardCtx, relayPort, f, tc.Stdout)
+	}
+	events := newEventWriter(c)
+	teleconsoleID := geo.SesionPrefixFor(c.GetEndpointHost()) + sid
+	events.Emit(lib.Event{
+		Type:      lib.EventSessionJoined,
+		SessionID: teleconsoleID,
+		Login:     session.Login,
+		Observer:  session.Observer,
+	})
 	// try to join up to 5 times:
 	for i := 0; i < 3; i++ {
-		if err = tc.Join(context.TODO(),
-			defaults.Namespace,
-			tsession.ID(session.TSID), nil); err == nil {
+		if session.Observer {
+			// the mirror gives everyone who logs in the shell's output:
+			err = tc.SSH(ctx, nil, false)
+		} else {
+			err = tc.Join(ctx, defaults.Namespace, tsession.ID(session.TSID), nil)
+		}
+		if err == nil {
 			break
 		}
 		log.Warning(err)
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
 	}
+	events.ended(teleconsoleID, err)
 	return trace.Wrap(err)
 }
 
-func findUserFor(session *lib.Session, fp string) (u *integration.User, err error) {
+// runRemoteForward keeps asking the broadcaster's relay (reachable via
+// 127.0.0.1:relayPort) to forward 'f' until the request gets through. The
+// forwarding stops when 'ctx' is done
+func runRemoteForward(ctx context.Context, relayPort int, f *lib.RemoteForward, out io.Writer) {
+	if out == nil {
+		out = os.Stdout
+	}
+	blue := color.New(color.FgHiBlue).SprintFunc()
+	relayAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(relayPort))
+	dial := func() (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", relayAddr)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		return conn, nil
+	}
+	ready := false
+	// the relay is unreachable until we join the session:
+	for i := 0; i < 30 && !ready; i++ {
+		select {
+		case <-time.After(SyncRefreshInterval):
+		case <-ctx.Done():
+			return
+		}
+		err := lib.RunRemoteForward(dial, f, func(addr string) {
+			ready = true
+			fmt.Fprintf(out, "\r\n%s %s on the broadcaster's machine leads to %s on yours\r\n",
+				blue("Teleconsole:"), addr, f.DestAddr())
+		})
+		if trace.IsAccessDenied(err) {
+			fmt.Fprintf(out, "\r\n%s %v\r\n", blue("Teleconsole:"), err)
+			return
+		}
+		if err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+// socksDestinations describes the SOCKS allow-list for humans
+func socksDestinations(list lib.SOCKSAllowList) string {
+	var dests []string
+	for _, r := range list {
+		dest := r.Host
+		if r.Net != nil {
+			dest = r.Net.String()
+		}
+		if r.Port != 0 {
+			dest = net.JoinHostPort(dest, strconv.Itoa(r.Port))
+		}
+		dests = append(dests, dest)
+	}
+	return strings.Join(dests, ", ")
+}
+
+// askNewPIN asks the broadcaster to choose the PIN of the session
+func askNewPIN() (string, error) {
+	pin, err := lib.ReadPassword("Choose a PIN for joining parties: ")
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if err = lib.CheckPINStrength(pin); err != nil {
+		return "", trace.Wrap(err)
+	}
+	again, err := lib.ReadPassword("Repeat the PIN: ")
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if pin != again {
+		return "", trace.Errorf("PINs do not match")
+	}
+	return pin, nil
+}
+
+// setStdio replaces the terminal of an SSH client with the configured
+// input/output streams (if any)
+func setStdio(c *conf.Config, tc *client.Config) {
+	if c.Stdin != nil {
+		tc.Stdin = c.Stdin
+	}
+	if c.Stdout != nil {
+		tc.Stdout = c.Stdout
+		tc.Stderr = c.Stdout
+	}
+}
+
+// findUserFor returns the session user we can log in as: the built-in
+// anonymous user or the one whose key we have. Keys held by ssh-agent are
+// returned as signers, with no private key in the user
+func findUserFor(out io.Writer, session *lib.Session, fp, pin string, keys *lib.Agent) (u *integration.User, signer ssh.Signer, err error) {
 	// is this a session with a built-in anonymous user we can use?
 	for _, user := range session.Secrets.Users {
 		if len(user.Key.Priv) > 0 {
-			return user, nil
+			// PIN-protected sessions have the keys sealed:
+			if lib.IsSealedKey(user.Key.Priv) {
+				if user.Key.Priv, err = lib.OpenKey(user.Key.Priv, pin); err != nil {
+					return nil, nil, trace.Wrap(err)
+				}
+			}
+			return user, nil, nil
 		}
 	}
 	matchingUserFor := func(i *lib.Identity) bool {
@@ -354,31 +937,67 @@ func findUserFor(session *lib.Session, fp string) (u *integration.User, err erro
 	if fp != "" {
 		i, err := lib.MakeIdentityFromFile(fp)
 		if err != nil {
-			return nil, trace.Wrap(err)
+			return nil, nil, trace.Wrap(err)
 		}
 		if matchingUserFor(i) {
-			return u, nil
+			return u, nil, nil
 		}
-		// look in ~/.ssh
+		// ask ssh-agent, then look in ~/.ssh
 	} else {
+		if keys != nil {
+			for un, user := range session.Secrets.Users {
+				if signer = keys.SignerFor(user.Key.Pub); signer != nil {
+					fmt.Fprintln(out, "Matching key: ssh-agent", ssh.FingerprintSHA256(signer.PublicKey()))
+					return &integration.User{
+						Username:      un,
+						AllowedLogins: user.AllowedLogins,
+						Key: &client.Key{
+							Pub:  user.Key.Pub,
+							Cert: user.Key.Cert,
+						},
+					}, signer, nil
+				}
+			}
+		}
 		me, err := user.Current()
 		if err != nil {
-			return nil, trace.Wrap(err)
+			return nil, nil, trace.Wrap(err)
 		}
 		matches, err := filepath.Glob(filepath.Join(me.HomeDir, ".ssh", "id_*"))
 		if err != nil {
-			return nil, trace.Wrap(err)
+			return nil, nil, trace.Wrap(err)
 		}
 		for _, fp := range matches {
+			// only keys of the session are loaded, so the user isn't asked
+			// for passphrases of the others:
+			if strings.HasSuffix(fp, ".pub") || !sessionHasKey(session, fp) {
+				continue
+			}
 			i, _ := lib.MakeIdentityFromFile(fp)
 			if i != nil && matchingUserFor(i) {
-				fmt.Println("Matching key:", fp)
-				return u, nil
+				fmt.Fprintln(out, "Matching key:", fp)
+				return u, nil, nil
 			}
 		}
 	}
-	return nil, trace.Errorf("\nTo join this session you must provide a valid SSH key.\n"+
-		"No matching keys were found on your machine in ~/.ssh\n"+
+	return nil, nil, trace.Errorf("\nTo join this session you must provide a valid SSH key.\n"+
+		"No matching keys were found in ssh-agent or on your machine in ~/.ssh\n"+
 		"Try specifying an SSH key file with -i flag, for example:\n\n"+
 		"> teleconsole -i ./id_rsa join %s\n", session.ID)
 }
+
+// sessionHasKey returns true if one of the session users logs in with the
+// key in the file
+func sessionHasKey(session *lib.Session, fp string) bool {
+	pub, err := lib.ReadPublicKey(fp)
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+	for _, user := range session.Secrets.Users {
+		if lib.KeyMatches(user.Key.Pub, pub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,368 @@
+package clt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/integration"
+	"github.com/gravitational/teleport/lib/client"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/gravitational/teleconsole/clt/clttest"
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (this *syncBuffer) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	return this.buf.Write(p)
+}
+
+func (this *syncBuffer) String() string {
+	this.Lock()
+	defer this.Unlock()
+	return this.buf.String()
+}
+
+func waitForOutput(out *syncBuffer, text string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if strings.Contains(out.String(), text) {
+			return true
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
+
+// TestBroadcastAndJoin starts a broadcast through a fake Teleconsole server
+// and joins it from another client on the same machine
+func TestBroadcastAndJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// broadcaster:
+	bin, bkeys := io.Pipe()
+	bout := &syncBuffer{}
+	bconf := srv.Config()
+	bconf.Stdin, bconf.Stdout = bin, bout
+	bapi := NewAPIClient(bconf, "0.0.1")
+	broadcastErr := make(chan error, 1)
+	go func() {
+		broadcastErr <- StartBroadcast(context.Background(), bconf, bapi)
+	}()
+	if _, err = srv.WaitFor("POST", "/api/session/", time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	// joining party:
+	jin, jkeys := io.Pipe()
+	jout := &syncBuffer{}
+	jconf := srv.Config()
+	jconf.Stdin, jconf.Stdout = jin, jout
+	japi := NewAPIClient(jconf, "0.0.1")
+	if err = japi.CheckVersion(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	joinErr := make(chan error, 1)
+	go func() {
+		joinErr <- Join(context.Background(), jconf, japi, bapi.SessionID)
+	}()
+
+	// whatever the joining party types must show up on the broadcaster's screen:
+	time.Sleep(time.Second * 2)
+	io.WriteString(jkeys, "echo joiner-was-$((20+22))\n")
+	if !waitForOutput(bout, "joiner-was-42", time.Second*10) {
+		t.Fatalf("broadcaster did not see joiner's command:\n%s", bout.String())
+	}
+	// broadcaster ends the session:
+	io.WriteString(bkeys, "exit\n")
+	for _, errC := range []chan error{broadcastErr, joinErr} {
+		select {
+		case err = <-errC:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatal("session did not end")
+		}
+	}
+	if len(srv.RequestsTo("POST", "/api/sessions")) != 1 {
+		t.Fatal("broadcaster must request exactly one session")
+	}
+}
+
+// TestBroadcastCommand makes sure the exit status of the command given
+// via -c becomes the result of the broadcast
+func TestBroadcastCommand(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	in, _ := io.Pipe()
+	c := srv.Config()
+	c.Stdin, c.Stdout = in, &syncBuffer{}
+	c.RunCommand = "echo it's done; exit 3"
+	err = StartBroadcast(context.Background(), c, NewAPIClient(c, "0.0.1"))
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+}
+
+// TestRemoteForwardStops makes sure remote forwarding does not outlive the
+// session, even while the broadcaster is yet to allow it
+func TestRemoteForwardStops(t *testing.T) {
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	asked := make(chan net.Conn, 1)
+	go func() {
+		// the relay never answers:
+		if conn, err := relay.Accept(); err == nil {
+			asked <- conn
+		}
+	}()
+	interval := SyncRefreshInterval
+	SyncRefreshInterval = time.Millisecond * 10
+	defer func() { SyncRefreshInterval = interval }()
+
+	f, err := lib.ParseRemoteForwardSpec("8080:localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		runRemoteForward(ctx, relay.Addr().(*net.TCPAddr).Port, f, ioutil.Discard)
+		close(done)
+	}()
+	select {
+	case conn := <-asked:
+		defer conn.Close()
+	case <-time.After(time.Second * 5):
+		t.Fatal("the relay is not asked")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("remote forwarding must stop with the session")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if q := shellQuote("it's"); q != `'it'\''s'` {
+		t.Fatalf("bad quoting: %s", q)
+	}
+}
+
+func TestMapPortInvites(t *testing.T) {
+	web, _ := lib.ParsePortInvite("web=3000")
+	db, _ := lib.ParsePortInvite("db=localhost:5432")
+	other, _ := lib.ParsePortInvite("8080")
+	m, _ := lib.ParsePortMapping("5432=0.0.0.0:15432")
+	err := mapPortInvites(ioutil.Discard, []*lib.PortInvite{web, db, other}, []*lib.PortMapping{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.SrcIP != "0.0.0.0" || db.SrcPort != 15432 {
+		t.Fatalf("mapping is not applied: %+v", db)
+	}
+	if web.SrcPort == 0 || other.SrcPort == 0 || web.SrcPort == other.SrcPort {
+		t.Fatalf("free ports are not picked: %v, %v", web.SrcPort, other.SrcPort)
+	}
+	if web.SrcIP != "127.0.0.1" {
+		t.Fatalf("unmapped invites must be local: %v", web.SrcIP)
+	}
+}
+
+// TestFindUserInAgent joins a key-restricted session with a key which is
+// only in ssh-agent
+func TestFindUserInAgent(t *testing.T) {
+	data, err := ioutil.ReadFile("../fixtures/ids/two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: priv})
+	dir, err := ioutil.TempDir("", "teleconsole-agent-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	prev := os.Getenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", prev)
+	os.Setenv("SSH_AUTH_SOCK", listener.Addr().String())
+	keys, err := lib.ConnectAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+
+	one, _ := ioutil.ReadFile("../fixtures/ids/one.pub")
+	two, _ := ioutil.ReadFile("../fixtures/ids/two.pub")
+	session := &lib.Session{ID: "test"}
+	session.Secrets.Users = map[string]*integration.User{
+		"one": {Username: "one", Key: &client.Key{Pub: one}},
+		"two": {Username: "two", Key: &client.Key{Pub: two, Cert: []byte("cert")}},
+	}
+	u, signer, err := findUserFor(ioutil.Discard, session, "", "", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "two" || signer == nil {
+		t.Fatalf("the agent's key is not picked: %v", u.Username)
+	}
+	if len(u.Key.Priv) != 0 || string(u.Key.Cert) != "cert" {
+		t.Fatalf("the user must have the certificate and no private key: %+v", u.Key)
+	}
+}
+
+func TestCertifiedUserFor(t *testing.T) {
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// the key of "one" is certified by our CA:
+	caKey, err := ssh.ParsePrivateKey(mustRead(t, "../fixtures/ids/two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(mustRead(t, "../fixtures/ids/one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "alice",
+		ValidPrincipals: []string{"ops"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err = cert.SignCert(rand.Reader, caKey); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "teleconsole-certs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "id_rsa")
+	if err = ioutil.WriteFile(fp, mustRead(t, "../fixtures/ids/one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fp+certSuffix, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &lib.Session{ID: "test"}
+	session.TrustedCAs = []lib.TrustedCA{{
+		Key:        string(ssh.MarshalAuthorizedKey(caKey.PublicKey())),
+		Principals: []string{"ops"},
+		Login:      "user_ca",
+	}}
+	srv.Script("GET", "/api/sessions/test/certs", clttest.JSON(http.StatusOK, lib.CertChallenge{Nonce: "nonce"}))
+	srv.Script("POST", "/api/sessions/test/certs", clttest.JSON(http.StatusOK, lib.CertReply{
+		Username:      "user_ca",
+		AllowedLogins: []string{"guest"},
+		Cert:          "issued",
+	}))
+	api := NewAPIClient(srv.Config(), "0.0.1")
+	api.PIN = "1234"
+	u, certSigner, err := certifiedUserFor(context.Background(), ioutil.Discard, api, session, fp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "user_ca" || string(u.Key.Cert) != "issued" || len(u.Key.Priv) != 0 {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+	if !lib.KeyMatches(u.Key.Pub, certSigner.PublicKey()) {
+		t.Fatal("the signer must be for the certified key")
+	}
+	reqs := srv.RequestsTo("POST", "/api/sessions/test/certs")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 certificate request, got %d", len(reqs))
+	}
+	// the server checks the PIN of protected sessions:
+	if reqs[0].Header.Get(lib.PINHeader) != "1234" {
+		t.Fatal("the certificate request must carry the PIN")
+	}
+	var req lib.CertRequest
+	if err = json.Unmarshal(reqs[0].Body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.Verify("test"); err != nil || req.Nonce != "nonce" {
+		t.Fatalf("the request must be signed over the server's nonce: %v", err)
+	}
+
+	// certificates of other CAs are not even offered:
+	session.TrustedCAs[0].Key = string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if _, _, err = certifiedUserFor(context.Background(), ioutil.Discard, api, session, fp, nil); err == nil {
+		t.Fatal("the certificate of an untrusted CA must not be used")
+	}
+	if len(srv.RequestsTo("POST", "/api/sessions/test/certs")) != 1 {
+		t.Fatal("the certificate of an untrusted CA must not be sent")
+	}
+}
+
+// mustRead returns the contents of the file
+func mustRead(t *testing.T, fp string) []byte {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
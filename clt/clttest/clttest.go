@@ -0,0 +1,191 @@
+// Package clttest provides an in-process stand-in for the Teleconsole API
+// server to be used in end-to-end tests of the client.
+//
+// By default every request is served by a real (self-hosted) Teleconsole
+// server, which launches real disposable proxies on localhost. Individual
+// requests can be scripted to return redirects, warnings or errors instead:
+//
+//	srv, _ := clttest.New()
+//	defer srv.Close()
+//	srv.Script("GET", "/api/version", clttest.Redirect(other.URL))
+//	api := clt.NewAPIClient(srv.Config(), "0.0.1")
+package clttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/server"
+	"github.com/gravitational/trace"
+)
+
+// Request is an API request recorded by the fake server
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Response is a scripted reply to an API request
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Redirect returns a 307 response pointing to a given URL, this is how
+// Teleconsole servers send clients to a less busy server
+func Redirect(location string) Response {
+	return Response{
+		Status: http.StatusTemporaryRedirect,
+		Header: http.Header{"Location": []string{location}},
+	}
+}
+
+// JSON returns a response with 'v' marshalled as JSON body
+func JSON(status int, v interface{}) Response {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return Response{
+		Status: status,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   body,
+	}
+}
+
+// Error returns a response carrying an error message the way Teleconsole
+// servers do it
+func Error(status int, message string) Response {
+	return JSON(status, map[string]string{"message": message})
+}
+
+// Text returns a plain text response
+func Text(status int, body string) Response {
+	return Response{Status: status, Body: []byte(body)}
+}
+
+// Server is a fake Teleconsole server. It records all requests and replies
+// with scripted responses, falling back to a real Teleconsole server
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+	backend  *server.Server
+	requests []Request
+	scripts  map[string][]Response
+}
+
+// New starts a new fake Teleconsole server on localhost
+func New() (*Server, error) {
+	backend, err := server.New(server.Config{ProxyHost: "127.0.0.1"})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this := &Server{
+		backend: backend,
+		scripts: make(map[string][]Response),
+	}
+	this.Server = httptest.NewTLSServer(http.HandlerFunc(this.serve))
+	return this, nil
+}
+
+// Close stops the server and all disposable proxies it has launched
+func (this *Server) Close() {
+	this.Server.Close()
+	this.backend.Close()
+}
+
+// Config returns Teleconsole client configuration pointing to this server
+func (this *Server) Config() *conf.Config {
+	c := &conf.Config{InsecureHTTPS: true}
+	if err := c.SetEndpointHost(this.Listener.Addr().String()); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Script queues responses for a given method and path. Each request
+// consumes one response, after they run out requests are served normally
+func (this *Server) Script(method, path string, responses ...Response) {
+	this.Lock()
+	defer this.Unlock()
+	key := method + " " + path
+	this.scripts[key] = append(this.scripts[key], responses...)
+}
+
+// Requests returns all requests received so far
+func (this *Server) Requests() []Request {
+	this.Lock()
+	defer this.Unlock()
+	return append([]Request{}, this.requests...)
+}
+
+// RequestsTo returns the recorded requests for a given method and path
+func (this *Server) RequestsTo(method, path string) (out []Request) {
+	for _, r := range this.Requests() {
+		if r.Method == method && r.Path == path {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// WaitFor waits until a request matching method and path prefix arrives
+// and returns it
+func (this *Server) WaitFor(method, pathPrefix string, timeout time.Duration) (*Request, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, r := range this.Requests() {
+			if r.Method == method && strings.HasPrefix(r.Path, pathPrefix) {
+				return &r, nil
+			}
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return nil, trace.LimitExceeded("no %s %s request in %v", method, pathPrefix, timeout)
+}
+
+func (this *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	this.Lock()
+	this.requests = append(this.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+		Body:   body,
+	})
+	key := r.Method + " " + r.URL.Path
+	var (
+		resp     Response
+		scripted bool
+	)
+	if queue := this.scripts[key]; len(queue) > 0 {
+		resp, scripted = queue[0], true
+		this.scripts[key] = queue[1:]
+	}
+	this.Unlock()
+
+	if !scripted {
+		this.backend.ServeHTTP(w, r)
+		return
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
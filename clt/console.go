@@ -0,0 +1,229 @@
+package clt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	// questionTimeout is how long the broadcaster has to answer a question
+	questionTimeout = time.Minute
+
+	// typeAheadDelay is how soon after a question keystrokes are taken as
+	// typed before it: they're meant for the shell, not answers
+	typeAheadDelay = time.Millisecond * 300
+
+	// maxAnswer is how long answers can be
+	maxAnswer = 32
+
+	// MenuHotkey (Ctrl-]) opens the broadcaster's menu
+	MenuHotkey = 0x1d
+)
+
+// console sits between the broadcaster's keyboard and the shared shell.
+// Keystrokes go to the shell, except while teleconsole asks the broadcaster
+// a question: then they're taken as the answer, up to Enter.
+type console struct {
+	// questions are asked one at a time
+	questionLock sync.Mutex
+
+	sync.Mutex
+	out     io.Writer
+	keys    chan []byte
+	pending []byte
+	answers chan string
+	// answer is typed so far, since 'asked'
+	answer []byte
+	asked  time.Time
+	// menu is called when the broadcaster presses MenuHotkey
+	menu     func()
+	menuOpen bool
+}
+
+// newConsole starts reading the broadcaster's keyboard from 'in'
+func newConsole(in io.Reader, out io.Writer) *console {
+	this := &console{
+		out:  out,
+		keys: make(chan []byte),
+	}
+	go this.pump(in)
+	return this
+}
+
+// OnMenu sets the function which shows the broadcaster's menu
+func (this *console) OnMenu(menu func()) {
+	this.Lock()
+	defer this.Unlock()
+	this.menu = menu
+}
+
+func (this *console) pump(in io.Reader) {
+	defer close(this.keys)
+	for {
+		buf := make([]byte, 1024)
+		n, err := in.Read(buf)
+		keys := this.hotkey(buf[:n])
+		if len(keys) > 0 && !this.takeAnswer(keys) {
+			this.keys <- keys
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hotkey opens the menu if the keystrokes have MenuHotkey. Returns the rest
+// of the keystrokes
+func (this *console) hotkey(keys []byte) []byte {
+	i := bytes.IndexByte(keys, MenuHotkey)
+	if i < 0 {
+		return keys
+	}
+	this.Lock()
+	menu := this.menu
+	open := this.menuOpen || this.answers != nil
+	if menu != nil && !open {
+		this.menuOpen = true
+	}
+	this.Unlock()
+	if menu == nil {
+		return keys
+	}
+	if !open {
+		go func() {
+			menu()
+			this.Lock()
+			this.menuOpen = false
+			this.Unlock()
+		}()
+	}
+	return append(keys[:i], keys[i+1:]...)
+}
+
+// takeAnswer takes the keystrokes as the answer to the current question,
+// echoing them. The answer is complete on Enter, Ctrl+C cancels it.
+// Returns false if there is no question or the keystrokes are for the shell
+func (this *console) takeAnswer(keys []byte) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.answers == nil {
+		return false
+	}
+	// these were typed before the question, for the shell. Mistaking them
+	// for the answer could let someone in:
+	if time.Since(this.asked) < typeAheadDelay {
+		return false
+	}
+	for _, k := range keys {
+		switch {
+		case k == '\r' || k == '\n':
+			this.answers <- string(this.answer)
+			this.answers = nil
+			return true
+		case k == 0x03:
+			this.answers <- ""
+			this.answers = nil
+			return true
+		case k == 0x7f || k == '\b':
+			if len(this.answer) > 0 {
+				this.answer = this.answer[:len(this.answer)-1]
+				fmt.Fprint(this.out, "\b \b")
+			}
+		case k >= ' ' && k < 0x7f && len(this.answer) < maxAnswer:
+			this.answer = append(this.answer, k)
+			fmt.Fprintf(this.out, "%c", k)
+		}
+	}
+	return true
+}
+
+// Read returns the keystrokes meant for the shell
+func (this *console) Read(p []byte) (int, error) {
+	if len(this.pending) == 0 {
+		keys, ok := <-this.keys
+		if !ok {
+			return 0, io.EOF
+		}
+		this.pending = keys
+	}
+	n := copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
+
+// Notice prints a message for the broadcaster
+func (this *console) Notice(format string, args ...interface{}) {
+	bold := color.New(color.Bold).SprintFunc()
+	fmt.Fprintf(this.out, "\r\n%s %s\r\n", bold("Teleconsole:"), fmt.Sprintf(format, args...))
+}
+
+// Ask prints a yes/no question and waits for the broadcaster to answer it
+// with "y" and Enter. Anything else, no answer within a minute or 'ctx'
+// being done means "no"
+func (this *console) Ask(ctx context.Context, question string) bool {
+	answer, ok := this.question(ctx, question+" [y/N] ")
+	if !ok {
+		fmt.Fprint(this.out, "no answer, denied\r\n")
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	yes := answer == "y" || answer == "yes"
+	if yes {
+		fmt.Fprint(this.out, " (yes)\r\n")
+	} else {
+		fmt.Fprint(this.out, " (no)\r\n")
+	}
+	return yes
+}
+
+// Choose prints the question and waits for the broadcaster to pick one of
+// n choices. Returns the choice (1..n) or 0 if nothing is chosen
+func (this *console) Choose(ctx context.Context, question string, n int) int {
+	answer, ok := this.question(ctx, fmt.Sprintf("%s [1-%d, anything else to cancel] ", question, n))
+	choice, err := strconv.Atoi(strings.TrimSpace(answer))
+	if !ok || err != nil || choice < 1 || choice > n {
+		fmt.Fprint(this.out, " cancelled\r\n")
+		return 0
+	}
+	fmt.Fprint(this.out, "\r\n")
+	return choice
+}
+
+// question prints the prompt and waits for the answer. Returns false if
+// the broadcaster has not answered in time or 'ctx' is done
+func (this *console) question(ctx context.Context, prompt string) (string, bool) {
+	this.questionLock.Lock()
+	defer this.questionLock.Unlock()
+
+	bold := color.New(color.Bold).SprintFunc()
+	fmt.Fprintf(this.out, "\r\n%s %s", bold("Teleconsole:"), prompt)
+
+	answers := make(chan string, 1)
+	this.Lock()
+	this.answers = answers
+	this.answer = nil
+	this.asked = time.Now()
+	this.Unlock()
+	defer func() {
+		this.Lock()
+		this.answers = nil
+		this.Unlock()
+	}()
+
+	select {
+	case answer := <-answers:
+		return answer, true
+	case <-time.After(questionTimeout):
+		return "", false
+	case <-ctx.Done():
+		return "", false
+	}
+}
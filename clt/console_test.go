@@ -0,0 +1,96 @@
+package clt
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConsole(t *testing.T) {
+	in, keys := io.Pipe()
+	out := &syncBuffer{}
+	c := newConsole(in, out)
+	menuC := make(chan bool, 1)
+	c.OnMenu(func() { menuC <- true })
+
+	read := func() string {
+		buf := make([]byte, 100)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// keystrokes go to the shell:
+	go io.WriteString(keys, "ls\n")
+	if s := read(); s != "ls\n" {
+		t.Fatalf("unexpected keys %q", s)
+	}
+
+	// except for the menu hotkey:
+	go keys.Write([]byte{'a', MenuHotkey, 'b'})
+	if s := read(); s != "ab" {
+		t.Fatalf("unexpected keys %q", s)
+	}
+	select {
+	case <-menuC:
+	case <-time.After(time.Second):
+		t.Fatal("menu is not shown")
+	}
+
+	// and answers to questions, typed after them up to Enter:
+	answerC := make(chan bool)
+	ask := func(question string) {
+		go func() { answerC <- c.Ask(context.Background(), question) }()
+		waitForOutput(out, question+" [y/N]", time.Second)
+	}
+	noAnswer := func(why string) {
+		select {
+		case <-answerC:
+			t.Fatal(why)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	ask("Allow?")
+	go io.WriteString(keys, "y\r")
+	if s := read(); s != "y\r" {
+		t.Fatalf("keys typed before the question must go to the shell, got %q", s)
+	}
+	noAnswer("keys typed before the question must not answer it")
+	time.Sleep(typeAheadDelay)
+	io.WriteString(keys, "y")
+	noAnswer("the answer is complete on Enter only")
+	io.WriteString(keys, "\r")
+	if !<-answerC {
+		t.Fatal("expected 'yes'")
+	}
+	ask("Allow once more?")
+	time.Sleep(typeAheadDelay)
+	io.WriteString(keys, "yikes\r")
+	if <-answerC {
+		t.Fatal("anything but 'y' means 'no'")
+	}
+	choiceC := make(chan int)
+	go func() { choiceC <- c.Choose(context.Background(), "Which one?", 3) }()
+	waitForOutput(out, "Which one? [1-3", time.Second)
+	time.Sleep(typeAheadDelay)
+	io.WriteString(keys, "2\r")
+	if n := <-choiceC; n != 2 {
+		t.Fatalf("expected 2, got %v", n)
+	}
+	go func() { choiceC <- c.Choose(context.Background(), "Which one again?", 3) }()
+	waitForOutput(out, "Which one again?", time.Second)
+	time.Sleep(typeAheadDelay)
+	io.WriteString(keys, "7\r")
+	if n := <-choiceC; n != 0 {
+		t.Fatalf("out of range choice must cancel, got %v", n)
+	}
+
+	// the shell gets the keys again:
+	go io.WriteString(keys, "pwd\n")
+	if s := read(); s != "pwd\n" {
+		t.Fatalf("unexpected keys %q", s)
+	}
+}
@@ -0,0 +1,89 @@
+package clt
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// eventWriter writes events as JSON lines and hands them to the program
+// embedding Teleconsole. A nil eventWriter ignores everything
+type eventWriter struct {
+	sync.Mutex
+	out     io.Writer
+	onEvent func(lib.Event)
+}
+
+// newEventWriter returns the writer of events configured by 'c' or nil
+// if nobody is interested in them
+func newEventWriter(c *conf.Config) *eventWriter {
+	if c.Events == nil && c.OnEvent == nil {
+		return nil
+	}
+	return &eventWriter{out: c.Events, onEvent: c.OnEvent}
+}
+
+// Emit writes the event, setting its time
+func (this *eventWriter) Emit(e lib.Event) {
+	if this == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	this.Lock()
+	defer this.Unlock()
+	if this.out != nil {
+		json.NewEncoder(this.out).Encode(&e)
+	}
+	if this.onEvent != nil {
+		this.onEvent(e)
+	}
+}
+
+func (this *eventWriter) partyJoined(p lib.Party) {
+	this.Emit(lib.Event{Type: lib.EventPartyJoined, Party: &p})
+}
+
+func (this *eventWriter) partyLeft(p lib.Party) {
+	this.Emit(lib.Event{Type: lib.EventPartyLeft, Party: &p})
+}
+
+// ended emits session_ended with the outcome of the SSH session
+func (this *eventWriter) ended(sid string, err error) {
+	e := lib.Event{Type: lib.EventSessionEnded, SessionID: sid}
+	if code, ok := exitStatus(err); ok {
+		e.ExitCode = &code
+	} else {
+		e.Error = err.Error()
+	}
+	this.Emit(e)
+}
+
+// OpenEventOutput opens the destination of machine-readable output:
+// "fd:N" for an inherited file descriptor or a file name
+func OpenEventOutput(spec string) (io.WriteCloser, error) {
+	if strings.HasPrefix(spec, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, "fd:"))
+		if err != nil || fd < 1 {
+			return nil, trace.BadParameter("invalid file descriptor '%s'", spec)
+		}
+		f := os.NewFile(uintptr(fd), spec)
+		if _, err = f.Stat(); err != nil {
+			return nil, trace.BadParameter("file descriptor %d is not open", fd)
+		}
+		return f, nil
+	}
+	f, err := os.OpenFile(spec, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return f, nil
+}
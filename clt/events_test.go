@@ -0,0 +1,65 @@
+package clt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/lib"
+)
+
+func TestEvents(t *testing.T) {
+	var out bytes.Buffer
+	events := newEventWriter(&conf.Config{Events: &out})
+	events.Emit(lib.Event{Type: lib.EventSessionCreated, SessionID: "abc"})
+	events.partyJoined(lib.Party{FullName: "Alice"})
+	events.ended("abc", nil)
+	events.ended("abc", fmt.Errorf("broken pipe"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 events, got %q", out.String())
+	}
+	var e lib.Event
+	for i, expected := range []string{lib.EventSessionCreated, lib.EventPartyJoined, lib.EventSessionEnded, lib.EventSessionEnded} {
+		e = lib.Event{}
+		if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != expected || e.Time.IsZero() {
+			t.Fatalf("unexpected event %q", lines[i])
+		}
+	}
+	if e.Error != "broken pipe" || e.ExitCode != nil {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// nobody asked for events:
+	events = newEventWriter(&conf.Config{})
+	events.Emit(lib.Event{Type: lib.EventSessionCreated})
+}
+
+func TestOpenEventOutput(t *testing.T) {
+	if _, err := OpenEventOutput("fd:x"); err == nil {
+		t.Fatal("invalid file descriptor must be rejected")
+	}
+	if _, err := OpenEventOutput("fd:1000"); err == nil {
+		t.Fatal("closed file descriptor must be rejected")
+	}
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := OpenEventOutput(filepath.Join(dir, "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
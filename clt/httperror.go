@@ -51,3 +51,15 @@ func makeHTTPError(r *http.Response) error {
 func (this *HTTPClientError) Error() string {
 	return fmt.Sprintf("%s: %s", this.Status, this.Message)
 }
+
+// PINError is returned when a session is protected with a PIN and the
+// PIN was not given or is wrong
+type PINError struct {
+	*HTTPClientError
+}
+
+// KnockError is returned when a session requires the broadcaster's approval
+// and the joining party has not been approved yet
+type KnockError struct {
+	*HTTPClientError
+}
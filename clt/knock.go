@@ -0,0 +1,150 @@
+package clt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fatih/color"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// knockTimeout is how long a joining party waits for the broadcaster to
+// let them in (the server gives up on knocks a bit later)
+const knockTimeout = time.Minute + time.Second*30
+
+// knock asks the broadcaster of the session to let us in and waits for
+// the decision. On success the API client is ready to get session details
+func knock(ctx context.Context, c *conf.Config, api *APIClient, sid string, keys *lib.Agent) error {
+	blue := color.New(color.FgHiBlue).SprintFunc()
+	k := &lib.Knock{Name: c.Name}
+	// prove we have the key the broadcaster may recognize:
+	if signer := knockSigner(c.IdentityFile, keys); signer != nil {
+		if err := k.Sign(sid, signer); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	k, err := api.Knock(ctx, sid, k)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	fmt.Fprintf(c.GetMessageOut(), "%s waiting for the broadcaster to let you in...\n\r", blue("Teleconsole:"))
+	for deadline := time.Now().Add(knockTimeout); time.Now().Before(deadline); {
+		switch k.Status {
+		case lib.KnockApproved:
+			api.KnockID = k.ID
+			return nil
+		case lib.KnockDenied:
+			return trace.AccessDenied("The broadcaster has not let you in")
+		}
+		select {
+		case <-time.After(SyncRefreshInterval):
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
+		if k, err = api.GetKnock(ctx, sid, k.ID); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return trace.LimitExceeded("The broadcaster has not answered, try again later")
+}
+
+// announcedName is the name joining parties introduce themselves with
+// unless they've picked one with -name: the full name of the OS user or
+// their login
+func announcedName() string {
+	me, err := user.Current()
+	if err != nil {
+		return "someone"
+	}
+	if name := lib.CleanName(strings.Split(me.Name, ",")[0]); name != "" {
+		return name
+	}
+	return me.Username
+}
+
+// knockSigner returns the key to sign knocks with: the identity file, the
+// first usable key in ~/.ssh or the first key of ssh-agent. Returns nil if
+// there's none
+func knockSigner(fp string, keys *lib.Agent) ssh.Signer {
+	if fp != "" {
+		_, signer, err := lib.ReadPrivateKey(fp)
+		if err != nil {
+			log.Debug(err)
+			return nil
+		}
+		return signer
+	}
+	me, err := user.Current()
+	if err != nil {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(me.HomeDir, ".ssh", "id_*"))
+	for _, f := range files {
+		if strings.HasSuffix(f, ".pub") {
+			continue
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		// encrypted keys fail here: nobody is asked for a passphrase
+		// just to knock
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			return signer
+		}
+	}
+	if keys != nil {
+		if signers, err := keys.Signers(); err == nil && len(signers) > 0 {
+			return signers[0]
+		}
+	}
+	return nil
+}
+
+// watchKnocks asks the broadcaster about every party knocking on the
+// session until 'ctx' is done
+func watchKnocks(ctx context.Context, api *APIClient, console *console) {
+	ticker := time.NewTicker(SyncRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		knocks, err := api.GetPendingKnocks(ctx, api.SessionID)
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+		for _, k := range knocks {
+			approved := console.Ask(ctx, describeKnock(&k)+" Let them in?")
+			if err = api.DecideKnock(ctx, api.SessionID, k.ID, approved); err != nil {
+				log.Warning(err)
+			}
+		}
+	}
+}
+
+// describeKnock tells the broadcaster who is knocking
+func describeKnock(k *lib.Knock) string {
+	key := "no key"
+	if k.Fingerprint != "" {
+		key = "key " + k.Fingerprint
+	}
+	as := ""
+	if k.Observer {
+		as = " as an observer"
+	}
+	return fmt.Sprintf("%q wants to join%s from %s (%s).", k.Name, as, k.RemoteAddr, key)
+}
@@ -1,14 +1,18 @@
 package clt
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gravitational/teleconsole/conf"
 	"github.com/gravitational/teleconsole/geo"
 	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleconsole/server"
 	"github.com/gravitational/teleconsole/version"
 
 	"github.com/gravitational/teleport/lib/auth/native"
@@ -63,6 +67,19 @@ func initLogging(verbosity int) {
 	}
 }
 
+// ConfigureTeleport tunes Teleport internals for Teleconsole. It must be
+// called before any session is started
+func ConfigureTeleport() {
+	// configure teleport internals to use our ping interval.
+	// IMPORANT: these must be similar for proxies and servers
+	teleport.SessionRefreshPeriod = SyncRefreshInterval
+	teleport.ReverseTunnelAgentHeartbeatPeriod = SyncRefreshInterval * 2
+	teleport.ServerHeartbeatTTL = SyncRefreshInterval * 2
+
+	// this disables costly Teleport "key pool"
+	native.PrecalculatedKeysNum = 0
+}
+
 // NewApp constructs and returns a "Teleconsole application object"
 // initialized with the command line arguments, values from the
 // configuration file, ready to run
@@ -79,8 +96,27 @@ func NewApp(fs *flag.FlagSet) (*App, error) {
 	serverFlag := fs.String("s", "", "")
 	insecure := fs.Bool("insecure", false, "")
 	forwardPorts := fs.String("L", "", "")
-	forwardAddr := fs.String("f", "", "")
+	var forwardAddrs stringList
+	fs.Var(&forwardAddrs, "f", "")
+	var portMappings stringList
+	fs.Var(&portMappings, "map", "")
+	var remoteForwards stringList
+	fs.Var(&remoteForwards, "R", "")
+	var dynamicForwards stringList
+	fs.Var(&dynamicForwards, "D", "")
+	socksAllow := fs.String("socks", "", "")
+	pin := fs.Bool("pin", false, "")
+	approve := fs.Bool("approve", false, "")
+	notify := fs.String("notify", NotifyTitle, "")
+	name := fs.String("name", "", "")
+	output := fs.String("output", "text", "")
+	apiTimeout := fs.Duration("timeout", conf.DefaultAPITimeout, "")
+	setupTimeout := fs.Duration("setup-timeout", conf.DefaultSetupTimeout, "")
+	outputFile := fs.String("output-file", "", "")
 	identityFile := fs.String("i", "", "")
+	githubAPI := fs.String("github-api", "", "")
+	observers := fs.Bool("observers", false, "")
+	recordFile := fs.String("record", "", "")
 
 	fs.Usage = printHelp
 	fs.Parse(os.Args[1:])
@@ -97,19 +133,12 @@ func NewApp(fs *flag.FlagSet) (*App, error) {
 	}
 	initLogging(verbosity)
 
-	// configure teleport internals to use our ping interval.
-	// IMPORANT: these must be similar for proxies and servers
-	teleport.SessionRefreshPeriod = SyncRefreshInterval
-	teleport.ReverseTunnelAgentHeartbeatPeriod = SyncRefreshInterval * 2
-	teleport.ServerHeartbeatTTL = SyncRefreshInterval * 2
-
-	// this disables costly Teleport "key pool"
-	native.PrecalculatedKeysNum = 0
+	ConfigureTeleport()
 
 	// read configuration from rcfile in ~/
 	config, err := conf.Get()
 	if err != nil {
-		log.Fatal("Configuration error: ", err)
+		return nil, trace.Errorf("Configuration error: %v", err)
 	}
 	// apply CLI flags to the config:
 	if *serverFlag != "" {
@@ -125,19 +154,77 @@ func NewApp(fs *flag.FlagSet) (*App, error) {
 			return nil, err
 		}
 	}
-	if *forwardAddr != "" {
-		config.ForwardPort, err = lib.ParseForwardAddr(*forwardAddr)
+	for _, spec := range forwardAddrs {
+		invite, err := lib.ParsePortInvite(spec)
 		if err != nil {
-			return nil, trace.Errorf("Invalid forwarding addres spec: %v\nExamples: localhost:5000 or http://gravitational.com", err)
+			return nil, trace.Errorf("Invalid forwarding addres spec: %v\nExamples: localhost:5000, http://gravitational.com or web=8080", err)
+		}
+		config.PortInvites = append(config.PortInvites, invite)
+	}
+	for _, spec := range portMappings {
+		m, err := lib.ParsePortMapping(spec)
+		if err != nil {
+			return nil, trace.Errorf("Invalid -map spec: %v\nExamples: web=8080 or 5432=127.0.0.1:15432", err)
+		}
+		config.PortMappings = append(config.PortMappings, m)
+	}
+	for _, spec := range remoteForwards {
+		f, err := lib.ParseRemoteForwardSpec(spec)
+		if err != nil {
+			return nil, trace.Errorf("Invalid -R spec: %v\nExamples: 8080:localhost:3000 or 0.0.0.0:8080:localhost:3000", err)
+		}
+		config.RemoteForwards = append(config.RemoteForwards, f)
+	}
+	for _, spec := range dynamicForwards {
+		ip, port, err := lib.ParseDynamicForwardSpec(spec)
+		if err != nil {
+			return nil, trace.Errorf("Invalid -D spec: %v\nExamples: 1080 or 127.0.0.1:1080", err)
+		}
+		config.DynamicForwards = append(config.DynamicForwards, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+	if *socksAllow != "" {
+		if config.SOCKSAllowList, err = lib.ParseSOCKSAllowList(*socksAllow); err != nil {
+			return nil, trace.Errorf("Invalid -socks allow-list: %v\nExample: db.internal:5432,10.0.0.0/8", err)
 		}
 	}
 	// identity file:
 	config.IdentityFile = *identityFile
+	if *githubAPI != "" {
+		config.GithubAPI = *githubAPI
+	}
 
 	config.Verbosity = verbosity
 	config.RunCommand = *runCommand
 	config.Args = cliArgs
 	config.InsecureHTTPS = *insecure
+	config.Observers = *observers
+	config.RecordFile = *recordFile
+	config.PINProtected = *pin
+	config.Approve = *approve
+	config.Name = lib.CleanName(*name)
+	config.APITimeout = *apiTimeout
+	config.SetupTimeout = *setupTimeout
+	switch *output {
+	case "text":
+		if *outputFile != "" {
+			return nil, trace.Errorf("-output-file requires -output json")
+		}
+	case "json":
+		if *outputFile == "" {
+			return nil, trace.Errorf("-output json requires -output-file (a file name or fd:N)")
+		}
+		if config.Events, err = OpenEventOutput(*outputFile); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	default:
+		return nil, trace.Errorf("Invalid -output value '%s', expected text or json", *output)
+	}
+	switch *notify {
+	case NotifyTitle, NotifyLine, NotifyNone:
+		config.Notify = *notify
+	default:
+		return nil, trace.Errorf("Invalid -notify value '%s', expected title, line or none", *notify)
+	}
 
 	return &App{
 		Args:   cliArgs,
@@ -146,11 +233,23 @@ func NewApp(fs *flag.FlagSet) (*App, error) {
 	}, nil
 }
 
+// stringList is a flag which can be given multiple times
+type stringList []string
+
+func (this *stringList) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *stringList) Set(v string) error {
+	*this = append(*this, v)
+	return nil
+}
+
 func (this *App) Usage() {
 	printHelp()
 }
 
-func (this *App) Join() error {
+func (this *App) Join(ctx context.Context) error {
 	if len(this.Args) < 2 {
 		return trace.Errorf("Error: need an argument: session ID")
 	}
@@ -163,23 +262,70 @@ func (this *App) Join() error {
 			this.client.Endpoint = this.conf.APIEndpointURL
 		}
 	}
-	return Join(this.conf, this.client, sid)
+	return Join(ctx, this.conf, this.client, sid)
+}
+
+// Server runs a self-hosted Teleconsole API server. It has its own set of
+// flags which follow the 'server' command
+func (this *App) Server() error {
+	fs := flag.NewFlagSet("teleconsole server", flag.ExitOnError)
+	listenAddr := fs.String("listen", server.DefaultListenAddr, "")
+	proxyHost := fs.String("proxy-host", server.DefaultProxyHost, "")
+	certFile := fs.String("cert", "", "")
+	keyFile := fs.String("key", "", "")
+	warning := fs.String("warn", "", "")
+	fs.Usage = printHelp
+	fs.Parse(this.Args[1:])
+
+	srv, err := server.New(server.Config{
+		ListenAddr: *listenAddr,
+		ProxyHost:  *proxyHost,
+		CertFile:   *certFile,
+		KeyFile:    *keyFile,
+		WarningMsg: *warning,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	fmt.Printf("Teleconsole server is listening on %s\n", *listenAddr)
+	return srv.ListenAndServe()
+}
+
+// Play replays a recorded session. It has its own set of flags which
+// follow the 'play' command
+func (this *App) Play() error {
+	fs := flag.NewFlagSet("teleconsole play", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "")
+	idleLimit := fs.Duration("idle-limit", 0, "")
+	seek := fs.Duration("seek", 0, "")
+	fs.Usage = printHelp
+	fs.Parse(this.Args[1:])
+	if fs.NArg() < 1 {
+		return trace.Errorf("Error: need an argument: recording file")
+	}
+	p := &Player{
+		Speed:     *speed,
+		IdleLimit: *idleLimit,
+		Seek:      *seek,
+		Out:       os.Stdout,
+	}
+	return p.PlayFile(fs.Arg(0))
 }
 
 // Start starts a new session. This is what happens by default when you launch
 // teleconsole without parameters
 //
-func (this *App) Start() error {
+func (this *App) Start(ctx context.Context) error {
 	// are we using the default endpoint? if so, try to find the fastest one:
 	if !this.IsEndpointSpecified() {
-		err := this.conf.SetEndpointHost(geo.FindFastestEndpoint().Hostname)
+		err := this.conf.SetEndpointHost(geo.FindFastestEndpoint(ctx).Hostname)
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		// switch to the fastest endpoint:
 		this.client.Endpoint = this.conf.APIEndpointURL
 	}
-	return StartBroadcast(this.conf, this.client, this.Args[0:])
+	return StartBroadcast(ctx, this.conf, this.client)
 }
 
 // IsEndpointSpecified returns 'true' if the server endpoint has been set
@@ -203,17 +349,81 @@ friends into it.
 Simply close the session to stop sharing.
 
 Flags:
-   -f host:port  Invite joining parties to connect to host:port
+   -f host:port  Invite joining parties to connect to host:port. Can be
+                 repeated and labeled, like -f web=3000 -f db=localhost:5432
+   -c command    Share this command instead of a shell. The session ends
+                 when it exits and teleconsole exits with its status
    -L spec       Request port forwarding when joining an existing session
+   -map spec     Choose the local port for a port invite when joining, like
+                 -map web=8080. Can be repeated. Without it a free port is used
+   -R spec       Expose a port of your machine on the broadcaster's machine
+                 when joining, like -R 8080:localhost:3000. Can be repeated.
+                 The broadcaster must allow it by typing y and Enter
+   -socks list   Let joining parties use your machine as a SOCKS proxy, but
+                 only for the listed destinations, like 10.0.0.0/8,db:5432.
+                 The list is a convenience, not a security boundary: joining
+                 parties have your shell and can forward any port with -L
+   -D [ip:]port  Open a local SOCKS5 proxy leading through the broadcaster's
+                 machine when joining (they must use -socks)
+   -observers    Also create a read-only invite for observers who can only
+                 watch the session (they never reach your shell)
+   -record file  Record the session to a file (asciicast v2 format)
+   -pin          Protect the session with a PIN. You will be asked to choose
+                 one (at least 10 characters), and joining parties will need
+                 it besides the ID
+   -approve      Ask for your approval every time someone wants to join,
+                 showing their address, key fingerprint and name
+   -notify how   How to tell you about parties joining and leaving: in the
+                 terminal title, in a line of its own or not at all
+                 (title|line|none) [title]
+   -name name    Your name shown to the broadcaster when joining [your
+                 user name]
+   -output fmt   Also report the session events (created, joined, party
+                 joined/left, ended) as JSON lines with -output json [text]
+   -output-file  Where -output json goes: a file name or fd:N for an open
+                 file descriptor, like -output-file fd:3
    -insecure     When set, the client will trust invalid SSL certifates
+   -timeout d    Give up on the Teleconsole server if it does not answer a
+                 request in time [30s]
+   -setup-timeout d
+                 Give up on a broadcast which has not got through to the
+                 server in time [1m]
    -v            Verbose logging
    -vv           Extra verbose logging (debug mode)
    -s host:port  Teleconsole server address [teleconsole.com]
-   -i source     Identity to share a session with. Can be a Github user or 
-                 an identity file like ~/.ssh/id_rsa
+   -i source     Identity to share a session with. Can be a Github user,
+                 an identity file like ~/.ssh/id_rsa or public keys from
+                 github:user, gitlab:user[@host], bitbucket:user,
+                 url:https://... or file:authorized_keys. @org or
+                 @org/team shares it with members of a Github organization
+                 or team (set GITHUB_TOKEN to see teams).
+                 ca:user_ca.pub[#alice+bob] admits anyone with an OpenSSH
+                 certificate signed by the CA (for one of the principals)
+   -github-api url
+                 Github API for -i, like https://github.example.com/api/v3
+                 for Github Enterprise [https://api.github.com]
 Commands:
     help               Print this help
     join [session-id]  Join active session
+    play [flags] file  Replay a session recorded with -record
+    server [flags]     Run your own Teleconsole server
+
+Play flags:
+   -speed n          Playback speed multiplier [1.0]
+   -idle-limit time  Shorten pauses longer than this (e.g. 2s)
+   -seek time        Start playing from this moment (e.g. 1m30s)
+   While playing press Space to pause/resume, '.' to step, 'q' to quit
+
+Server flags:
+   -listen addr      Address to serve the API on [0.0.0.0:443]
+   -proxy-host host  Interface for disposable SSH proxies [0.0.0.0]
+   -cert file        TLS certificate (a self-signed one is used if not set)
+   -key file         TLS private key
+   -warn message     Warning message shown to every connecting client
+
+While broadcasting press Ctrl-] to list the parties who have joined and to
+kick one of them out. Kicked out parties can't join again from the same
+IP address.
 
 Examples:
   > teleconsole -f 5000  
@@ -221,21 +431,79 @@ Examples:
     Starts a shared SSH session, also letting joining parties access TCP 
     port 5000 on your machine.
 
+  > teleconsole -f web=3000 -f api=8080 -f db=localhost:5432
+
+    Invites joining parties to a web app, its API and its database, all
+    running on your machine.
+
   > teleconsole -f gravitational.com:80
 
     Starts a shared SSH session, forwarding TCP port 80 to joining parties.
     They will be able to visit http://gravitational.com using your machine
     as a proxy.
 
+  > teleconsole -c "make test"
+
+    Shares the output of "make test" with joining parties. The broadcast
+    ends when the tests finish, with the same exit code.
+
   > teleconsole -L 5000:gravitational.com:80 join <session-id>
 
     Joins the existing session requesting to forward gravitational.com:80
     to local port 5000.
 
+  > teleconsole play -speed 2 -idle-limit 1s session.cast
+
+    Replays a recorded session twice as fast, skipping long pauses.
+
+  > teleconsole server -cert cert.pem -key key.pem
+
+    Runs a self-hosted Teleconsole server. Broadcast and join through it
+    with "teleconsole -s yourserver.example.com".
+
+  > teleconsole -map web=8080 -map db=127.0.0.1:15432 join <session-id>
+
+    Joins the existing session, making the invites labeled "web" and "db"
+    available on local ports 8080 and 15432.
+
+  > teleconsole -R 8080:localhost:3000 join <session-id>
+
+    Joins the existing session, letting the broadcaster reach your local
+    port 3000 via port 8080 on their machine (if they allow it).
+
+  > teleconsole -socks "*.corp.example.com:443,10.1.0.0/16"
+
+    Starts a shared SSH session, letting joining parties reach the listed
+    internal services through your machine. They join with
+    "teleconsole -D 1080 join <session-id>" and point their browser or
+    tools to SOCKS5 proxy localhost:1080.
+
+  > teleconsole -pin
+
+    Starts a shared SSH session which can only be joined by those who know
+    both the session ID and the PIN you choose. Tell them the PIN in person.
+
   > teleconsole -i kontsevoy
 
     Starts a session shared only with "kontsevoy" Github user. Only a party
     with a private SSH key for "kontsevoy" will be able to join
 
+  > teleconsole -i gitlab:alice@gitlab.example.com,file:./team_keys
+
+    Starts a session shared only with "alice" on your GitLab and the keys
+    listed in ./team_keys (in authorized_keys format).
+
+  > GITHUB_TOKEN=... teleconsole -i @acme/oncall
+
+    Starts a session shared with every member of the "oncall" team of the
+    "acme" Github organization.
+
+  > teleconsole -i ca:/etc/ssh/user_ca.pub#ops
+
+    Starts a session shared with anyone holding a valid OpenSSH certificate
+    for the "ops" principal signed by your user CA. They join with the
+    certified key, the certificate is found next to it (id_rsa-cert.pub) or
+    in ssh-agent.
+
 Made by Gravitational Inc http://gravitational.com`)
 }
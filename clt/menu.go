@@ -0,0 +1,57 @@
+package clt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// partyMenu lists the parties who have joined the broadcast and lets the
+// broadcaster kick one of them out. Kicked out parties can't rejoin
+func partyMenu(ctx context.Context, api *APIClient, console *console) {
+	parties, err := api.GetParties(ctx, api.SessionID)
+	if err != nil {
+		console.Notice("failed to get the list of parties: %v", err)
+		return
+	}
+	if len(parties) == 0 {
+		console.Notice("nobody has joined yet")
+		return
+	}
+	if len(parties) > 9 {
+		parties = parties[:9]
+	}
+	lines := []string{"connected parties:"}
+	for i, p := range parties {
+		lines = append(lines, fmt.Sprintf("  %d) %s", i+1, describeParty(&p)))
+	}
+	console.Notice("%s", strings.Join(lines, "\r\n"))
+	n := console.Choose(ctx, "Kick out", len(parties))
+	if n == 0 {
+		return
+	}
+	p := parties[n-1]
+	if !console.Ask(ctx, fmt.Sprintf("Kick out %s and bar them from rejoining?", describeParty(&p))) {
+		return
+	}
+	if err = api.KickParty(ctx, api.SessionID, p.ID); err != nil {
+		console.Notice("failed to kick out %s: %v", partyName(&p), err)
+		return
+	}
+	console.Notice("%s has been kicked out", partyName(&p))
+}
+
+// describeParty returns a one-line description of a party for the broadcaster
+func describeParty(p *lib.Party) string {
+	s := p.RemoteAddr
+	if p.FullName != "" {
+		s = fmt.Sprintf("%s (%s)", p.FullName, p.RemoteAddr)
+	}
+	if !p.JoinedAt.IsZero() {
+		s += fmt.Sprintf(", joined %v ago", time.Since(p.JoinedAt).Truncate(time.Second))
+	}
+	return s
+}
@@ -0,0 +1,230 @@
+package clt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// mirrorBacklog is how much of the recent output a newly connected
+	// observer receives, so they don't stare at a blank screen
+	mirrorBacklog = 16 * 1024
+
+	// mirrorQueue is how many writes an observer may lag behind before
+	// they're dropped: observers who can't keep up must not slow us down
+	mirrorQueue = 256
+)
+
+// mirror copies the output of the shared shell to read-only observers.
+//
+// It's an SSH server of its own on the broadcaster's machine, observers
+// reach it through the proxy just like the broadcaster's SSH server. It
+// only lets in observers (ObserverLogin with certificates of the proxy),
+// never runs anything and ignores all input. The broadcaster's SSH server
+// does not let observers in at all, so they can't type into the shell
+type mirror struct {
+	sync.Mutex
+	listener net.Listener
+	config   *ssh.ServerConfig
+	// output queues of observers' sessions
+	observers map[ssh.Channel]chan []byte
+	backlog   []byte
+	closed    bool
+}
+
+// newMirror starts listening for observers on a random port of 'host'. It
+// accepts them after Start
+func newMirror(host string) (*mirror, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &mirror{
+		listener:  listener,
+		observers: make(map[ssh.Channel]chan []byte),
+	}, nil
+}
+
+// Addr returns host:port observers connect to
+func (this *mirror) Addr() string {
+	return this.listener.Addr().String()
+}
+
+// Start accepts observers. The mirror is known by a host certificate of
+// 'hostCA' (the CA of the broadcaster's SSH server, which joining parties
+// trust), observers log in with certificates of 'userCA' (the proxy's)
+func (this *mirror) Start(hostCA ssh.Signer, userCA ssh.PublicKey) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	host, _, _ := net.SplitHostPort(this.Addr())
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           host,
+		ValidPrincipals: []string{host},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err = cert.SignCert(rand.Reader, hostCA); err != nil {
+		return trace.Wrap(err)
+	}
+	hostSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), userCA.Marshal())
+		},
+	}
+	this.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// the certificates of the shell's users are signed by the
+			// same CA, but they're not for this login:
+			if conn.User() != lib.ObserverLogin {
+				return nil, trace.AccessDenied("only observers can log in")
+			}
+			if _, ok := key.(*ssh.Certificate); !ok {
+				return nil, trace.AccessDenied("a certificate is required")
+			}
+			return checker.Authenticate(conn, key)
+		},
+	}
+	this.config.AddHostKey(hostSigner)
+	go this.accept()
+	return nil
+}
+
+func (this *mirror) accept() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		go this.handle(conn)
+	}
+}
+
+// handle serves an observer's SSH connection: every session of it gets
+// the output, nothing else is allowed
+func (this *mirror) handle(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, this.config)
+	if err != nil {
+		log.Debugf("mirror: %v", err)
+		nc.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.Prohibited, "observers can only watch")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go io.Copy(ioutil.Discard, ch)
+		go func() {
+			for req := range requests {
+				switch req.Type {
+				case "pty-req", "window-change", "env":
+					req.Reply(true, nil)
+				case "shell":
+					req.Reply(true, nil)
+					go this.watch(ch)
+				default:
+					// no commands, subsystems or forwarding:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// watch sends the recent output and everything written afterwards to the
+// observer's session
+func (this *mirror) watch(ch ssh.Channel) {
+	defer ch.Close()
+	queue := make(chan []byte, mirrorQueue)
+	this.Lock()
+	if this.closed {
+		this.Unlock()
+		return
+	}
+	this.observers[ch] = queue
+	backlog := append([]byte(nil), this.backlog...)
+	this.Unlock()
+
+	if _, err := ch.Write(backlog); err != nil {
+		this.drop(ch)
+		return
+	}
+	for p := range queue {
+		if _, err := ch.Write(p); err != nil {
+			// the observer is gone:
+			this.drop(ch)
+			return
+		}
+	}
+}
+
+// drop stops sending the output to the observer's session
+func (this *mirror) drop(ch ssh.Channel) {
+	this.Lock()
+	defer this.Unlock()
+	if queue, ok := this.observers[ch]; ok {
+		close(queue)
+		delete(this.observers, ch)
+	}
+}
+
+// Write sends the shell output to all observers
+func (this *mirror) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.backlog = append(this.backlog, p...)
+	if len(this.backlog) > mirrorBacklog {
+		this.backlog = this.backlog[len(this.backlog)-mirrorBacklog:]
+	}
+	for ch, queue := range this.observers {
+		select {
+		case queue <- append([]byte(nil), p...):
+		default:
+			log.Debug("dropping an observer: too slow")
+			close(queue)
+			delete(this.observers, ch)
+			ch.Close()
+		}
+	}
+	return len(p), nil
+}
+
+// Close disconnects all observers
+func (this *mirror) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	for _, queue := range this.observers {
+		close(queue)
+	}
+	this.observers = nil
+	this.closed = true
+	return this.listener.Close()
+}
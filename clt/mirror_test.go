@@ -0,0 +1,121 @@
+package clt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleconsole/lib"
+)
+
+func TestMirror(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostCA, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCA, err := ssh.ParsePrivateKey(mustRead(t, "../fixtures/ids/two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.ParsePrivateKey(mustRead(t, "../fixtures/ids/one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMirror("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err = m.Start(hostCA, userCA.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	m.Write([]byte("before\n"))
+
+	// certify returns a signer presenting a certificate of 'ca' for the key
+	certify := func(ca ssh.Signer, principals ...string) ssh.Signer {
+		cert := &ssh.Certificate{
+			Key:             key.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: principals,
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewCertSigner(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	hostChecker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), hostCA.PublicKey().Marshal())
+		},
+	}
+	dial := func(login string, signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", m.Addr(), &ssh.ClientConfig{
+			User:            login,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostChecker.CheckHostKey,
+			Timeout:         time.Second * 5,
+		})
+	}
+
+	// observers only get in with the proxy's certificates:
+	if _, err = dial(lib.ObserverLogin, key); err == nil {
+		t.Fatal("observers without certificates must be rejected")
+	}
+	if _, err = dial(lib.ObserverLogin, certify(hostCA, lib.ObserverLogin)); err == nil {
+		t.Fatal("certificates of other CAs must be rejected")
+	}
+	if _, err = dial("root", certify(userCA, "root")); err == nil {
+		t.Fatal("only observers can log in")
+	}
+
+	client, err := dial(lib.ObserverLogin, certify(userCA, lib.ObserverLogin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// they can't run anything:
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Run("id"); err == nil {
+		t.Fatal("observers must not run commands")
+	}
+	// but they get the output:
+	s, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewReader(stdout)
+	line, err := lines.ReadString('\n')
+	if err != nil || line != "before\n" {
+		t.Fatalf("expected the backlog, got %q (%v)", line, err)
+	}
+	m.Write([]byte("after\n"))
+	if line, err = lines.ReadString('\n'); err != nil || line != "after\n" {
+		t.Fatalf("expected the new output, got %q (%v)", line, err)
+	}
+}
@@ -0,0 +1,163 @@
+package clt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// Player keyboard controls
+const (
+	keyPause = ' '
+	keyStep  = '.'
+	keyQuit  = 'q'
+	keyCtrlC = 3
+)
+
+// Player replays asciicast recordings in the terminal
+type Player struct {
+	// Speed multiplies the playback speed (1.0 is the original speed)
+	Speed float64
+
+	// IdleLimit caps the pauses between recorded events. Zero means
+	// the pauses are replayed as recorded
+	IdleLimit time.Duration
+
+	// Seek is the moment of the recording to start playing from. The
+	// output before it is printed instantly
+	Seek time.Duration
+
+	// Out is where the recording is played to
+	Out io.Writer
+
+	clock clockwork.Clock
+}
+
+// castFrame is a chunk of output to be printed after a delay
+type castFrame struct {
+	delay time.Duration
+	data  string
+}
+
+// castFrames turns recorded events into frames to play: output recorded
+// before 'seek' is returned separately, pauses longer than 'idleLimit'
+// are shortened
+func castFrames(events []lib.CastEvent, idleLimit, seek time.Duration) (skipped string, frames []castFrame) {
+	prev := seek
+	for _, e := range events {
+		if e.Type != lib.CastOutput {
+			continue
+		}
+		at := time.Duration(e.Time * float64(time.Second))
+		if at < seek {
+			skipped += e.Data
+			continue
+		}
+		delay := at - prev
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		frames = append(frames, castFrame{delay: delay, data: e.Data})
+		prev = at
+	}
+	return skipped, frames
+}
+
+// Play replays the events. The keys received via 'keys' control the
+// playback: space pauses and resumes, '.' steps forward while paused,
+// 'q' or Ctrl+C stop playing
+func (this *Player) Play(events []lib.CastEvent, keys <-chan byte) error {
+	if this.Speed <= 0 {
+		return trace.BadParameter("playback speed must be positive")
+	}
+	if this.clock == nil {
+		this.clock = clockwork.NewRealClock()
+	}
+	skipped, frames := castFrames(events, this.IdleLimit, this.Seek)
+	if _, err := io.WriteString(this.Out, skipped); err != nil {
+		return trace.Wrap(err)
+	}
+	paused := false
+	for _, f := range frames {
+		remaining := time.Duration(float64(f.delay) / this.Speed)
+	wait:
+		for paused || remaining > 0 {
+			var timer <-chan time.Time
+			if !paused {
+				timer = this.clock.After(remaining)
+			}
+			started := this.clock.Now()
+			select {
+			case <-timer:
+				break wait
+			case key, ok := <-keys:
+				// the time spent waiting counts, whatever the key is:
+				if !paused {
+					remaining -= this.clock.Now().Sub(started)
+				}
+				if !ok {
+					keys = nil
+					continue
+				}
+				switch key {
+				case keyQuit, keyCtrlC:
+					return nil
+				case keyPause:
+					paused = !paused
+				case keyStep:
+					if paused {
+						break wait
+					}
+				}
+			}
+		}
+		if _, err := io.WriteString(this.Out, f.data); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// PlayFile replays an asciicast file in the terminal
+func (this *Player) PlayFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer f.Close()
+	header, events, err := lib.ReadCast(f)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if width, height, err := lib.TerminalSize(); err == nil {
+		if width < header.Width || height < header.Height {
+			fmt.Fprintf(os.Stderr, "Warning: the session was recorded on a %dx%d terminal, yours is %dx%d\n",
+				header.Width, header.Height, width, height)
+		}
+	}
+	// read keystrokes (without waiting for Enter) to control the playback:
+	keys := make(chan byte)
+	if lib.IsTerminal() {
+		restore, err := lib.MakeRaw()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		defer restore()
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(buf); err != nil {
+					close(keys)
+					return
+				}
+				keys <- buf[0]
+			}
+		}()
+	}
+	return this.Play(events, keys)
+}
@@ -0,0 +1,97 @@
+package clt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/jonboulle/clockwork"
+)
+
+var testEvents = []lib.CastEvent{
+	{Time: 1, Type: lib.CastOutput, Data: "a"},
+	{Time: 2, Type: lib.CastResize, Data: "100x40"},
+	{Time: 3, Type: lib.CastOutput, Data: "b"},
+	{Time: 13, Type: lib.CastOutput, Data: "c"},
+}
+
+func TestCastFrames(t *testing.T) {
+	skipped, frames := castFrames(testEvents, 0, 0)
+	if skipped != "" || len(frames) != 3 {
+		t.Fatalf("unexpected frames: %q %v", skipped, frames)
+	}
+	if frames[0].delay != time.Second || frames[1].delay != time.Second*2 || frames[2].delay != time.Second*10 {
+		t.Fatalf("bad delays: %v", frames)
+	}
+	// cap pauses at 2 seconds:
+	_, frames = castFrames(testEvents, time.Second*2, 0)
+	if frames[2].delay != time.Second*2 {
+		t.Fatalf("idle time is not capped: %v", frames)
+	}
+	// seek to 2.5s:
+	skipped, frames = castFrames(testEvents, 0, time.Millisecond*2500)
+	if skipped != "a" || len(frames) != 2 {
+		t.Fatalf("bad seek: %q %v", skipped, frames)
+	}
+	if frames[0].delay != time.Millisecond*500 {
+		t.Fatalf("bad delay after seek: %v", frames[0].delay)
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	out := &syncBuffer{}
+	clock := clockwork.NewFakeClock()
+	p := &Player{Speed: 2, Out: out, clock: clock}
+	keys := make(chan byte)
+	done := make(chan error)
+	go func() {
+		done <- p.Play(testEvents, keys)
+	}()
+	// "a" is due in 0.5s at double speed:
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 500)
+	// pause before "b":
+	clock.BlockUntil(1)
+	keys <- keyPause
+	clock.Advance(time.Hour)
+	if out.String() != "a" {
+		t.Fatalf("expected 'a', got %q", out.String())
+	}
+	// step forward while paused:
+	keys <- keyStep
+	// resume, and quit:
+	keys <- keyPause
+	clock.BlockUntil(1)
+	keys <- keyQuit
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ab" {
+		t.Fatalf("expected 'ab', got %q", out.String())
+	}
+}
+
+// TestPlayerKeys makes sure keys which don't control the playback don't
+// hold it up
+func TestPlayerKeys(t *testing.T) {
+	out := &syncBuffer{}
+	clock := clockwork.NewFakeClock()
+	p := &Player{Speed: 1, Out: out, clock: clock}
+	keys := make(chan byte)
+	done := make(chan error)
+	go func() {
+		done <- p.Play(testEvents[:1], keys)
+	}()
+	// "a" is due in 1s:
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 600)
+	keys <- 'x'
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 400)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "a" {
+		t.Fatalf("expected 'a', got %q", out.String())
+	}
+}
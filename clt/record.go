@@ -0,0 +1,87 @@
+package clt
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/trace"
+)
+
+const (
+	defaultTermWidth  = 80
+	defaultTermHeight = 25
+)
+
+// recording saves the output of the shared shell into an asciicast file
+type recording struct {
+	*lib.CastWriter
+	file    *os.File
+	resizeC chan os.Signal
+	// failed is set once a write to the recording has failed
+	failed bool
+}
+
+// startRecording creates an asciicast file and starts tracking the size
+// of our terminal
+func startRecording(path string) (*recording, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	width, height, err := lib.TerminalSize()
+	if err != nil {
+		log.Debugf("cannot get terminal size: %v", err)
+		width, height = defaultTermWidth, defaultTermHeight
+	}
+	w, err := lib.NewCastWriter(f, width, height)
+	if err != nil {
+		f.Close()
+		return nil, trace.Wrap(err)
+	}
+	r := &recording{
+		CastWriter: w,
+		file:       f,
+		resizeC:    make(chan os.Signal, 1),
+	}
+	signal.Notify(r.resizeC, syscall.SIGWINCH)
+	go r.trackResize(width, height)
+	return r, nil
+}
+
+func (this *recording) trackResize(width, height int) {
+	for range this.resizeC {
+		w, h, err := lib.TerminalSize()
+		if err != nil || (w == width && h == height) {
+			continue
+		}
+		width, height = w, h
+		if err = this.Resize(width, height); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Write records the output. A broken recording must not stop the output
+// of the shell, so its first error is logged and the rest are ignored until
+// Close returns it
+func (this *recording) Write(p []byte) (int, error) {
+	if _, err := this.CastWriter.Write(p); err != nil && !this.failed {
+		this.failed = true
+		log.Errorf("the session is no longer recorded: %v", err)
+	}
+	return len(p), nil
+}
+
+// Close finishes the recording
+func (this *recording) Close() error {
+	signal.Stop(this.resizeC)
+	close(this.resizeC)
+	err := this.CastWriter.Close()
+	if e := this.file.Close(); err == nil {
+		err = e
+	}
+	return trace.Wrap(err)
+}
@@ -0,0 +1,34 @@
+package clt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBrokenRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teleconsole-rec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec, err := startRecording(filepath.Join(dir, "session.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rec.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the disk is gone:
+	rec.file.Close()
+	for i := 0; i < 2; i++ {
+		n, err := rec.Write([]byte("after\n"))
+		if n != len("after\n") || err != nil {
+			t.Fatalf("the shell output must go on, got %v, %v", n, err)
+		}
+	}
+	if err = rec.Close(); err == nil {
+		t.Fatal("the broken recording must be reported")
+	}
+}
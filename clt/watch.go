@@ -0,0 +1,165 @@
+package clt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleconsole/lib"
+)
+
+// Ways to notify the broadcaster about parties joining and leaving
+const (
+	NotifyTitle = "title"
+	NotifyLine  = "line"
+	NotifyNone  = "none"
+)
+
+// partyWatcher polls the list of parties and reports who joins and leaves
+type partyWatcher struct {
+	poll    func(context.Context) ([]lib.Party, error)
+	onJoin  func(lib.Party)
+	onLeave func(lib.Party)
+	// known parties, nil until the first poll
+	known map[string]lib.Party
+}
+
+// newPartyWatcher watches the parties of the broadcast. It prefers the
+// server's list of joining parties and falls back to session stats for
+// the servers which don't offer it
+func newPartyWatcher(api *APIClient, onJoin, onLeave func(lib.Party)) *partyWatcher {
+	this := &partyWatcher{onJoin: onJoin, onLeave: onLeave}
+	this.poll = func(ctx context.Context) ([]lib.Party, error) {
+		parties, err := api.GetParties(ctx, api.SessionID)
+		if herr, ok := trace.Unwrap(err).(*HTTPClientError); ok && herr.StatusCode == http.StatusNotFound {
+			stats, err := api.GetSessionStats(ctx, api.SessionID)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			return stats.Parties, nil
+		}
+		return parties, err
+	}
+	return this
+}
+
+// partyKey identifies a party between polls
+func partyKey(p *lib.Party) string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return fmt.Sprintf("%s/%v", p.RemoteAddr, p.Observer)
+}
+
+// check polls the parties once and reports the changes since the last
+// poll. The first poll only remembers who is there
+func (this *partyWatcher) check(ctx context.Context) error {
+	parties, err := this.poll(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	current := make(map[string]lib.Party)
+	for _, p := range parties {
+		current[partyKey(&p)] = p
+	}
+	if this.known != nil {
+		for key, p := range current {
+			if _, ok := this.known[key]; !ok && this.onJoin != nil {
+				this.onJoin(p)
+			}
+		}
+		for key, p := range this.known {
+			if _, ok := current[key]; !ok && this.onLeave != nil {
+				this.onLeave(p)
+			}
+		}
+	}
+	this.known = current
+	return nil
+}
+
+// run keeps polling until 'ctx' is done
+func (this *partyWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := this.check(ctx); err != nil {
+			log.Debug(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// background runs the goroutines which watch the broadcast, so it could
+// wait for them to be gone before it reports its end
+type background struct {
+	sync.WaitGroup
+}
+
+// Go runs 'f' in a goroutine of its own
+func (this *background) Go(f func()) {
+	this.Add(1)
+	go func() {
+		defer this.Done()
+		f()
+	}()
+}
+
+// partyNotifier tells the broadcaster about parties joining and leaving
+// in the terminal title or in a line of its own
+type partyNotifier struct {
+	mode    string
+	out     io.Writer
+	console *console
+}
+
+func (this *partyNotifier) joined(p lib.Party) {
+	joined := p.JoinedAt
+	if joined.IsZero() {
+		joined = time.Now()
+	}
+	this.notify(fmt.Sprintf("%s joined at %s", partyName(&p), joined.Format("15:04:05")))
+}
+
+func (this *partyNotifier) left(p lib.Party) {
+	this.notify(fmt.Sprintf("%s left at %s", partyName(&p), time.Now().Format("15:04:05")))
+}
+
+func (this *partyNotifier) notify(msg string) {
+	switch this.mode {
+	case NotifyTitle:
+		// OSC 0 sets the window title, it does not disturb the screen
+		fmt.Fprintf(this.out, "\033]0;Teleconsole: %s\007", msg)
+	case NotifyLine:
+		this.console.Notice("%s", msg)
+	}
+}
+
+// clear resets the terminal title when the broadcast ends
+func (this *partyNotifier) clear() {
+	if this.mode == NotifyTitle {
+		fmt.Fprint(this.out, "\033]0;\007")
+	}
+}
+
+// partyName describes a party in notices
+func partyName(p *lib.Party) string {
+	name := p.RemoteAddr
+	if p.FullName != "" {
+		name = p.FullName
+	}
+	if p.Observer {
+		return "observer " + name
+	}
+	return name
+}
@@ -0,0 +1,92 @@
+package clt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+)
+
+func TestPartyWatcher(t *testing.T) {
+	var parties []lib.Party
+	var joined, left []string
+	w := &partyWatcher{
+		poll:    func(context.Context) ([]lib.Party, error) { return parties, nil },
+		onJoin:  func(p lib.Party) { joined = append(joined, p.ID) },
+		onLeave: func(p lib.Party) { left = append(left, p.ID) },
+	}
+
+	// whoever is there at the first poll is not reported:
+	parties = []lib.Party{{ID: "a"}}
+	if err := w.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(joined) != 0 || len(left) != 0 {
+		t.Fatalf("unexpected reports: %v, %v", joined, left)
+	}
+
+	parties = []lib.Party{{ID: "a"}, {ID: "b"}}
+	w.check(context.Background())
+	if len(joined) != 1 || joined[0] != "b" || len(left) != 0 {
+		t.Fatalf("unexpected reports: %v, %v", joined, left)
+	}
+
+	parties = []lib.Party{{ID: "b"}}
+	w.check(context.Background())
+	if len(left) != 1 || left[0] != "a" || len(joined) != 1 {
+		t.Fatalf("unexpected reports: %v, %v", joined, left)
+	}
+}
+
+// TestWatcherStops ends a broadcast while the party watcher is polling:
+// nothing may be reported after the end
+func TestWatcherStops(t *testing.T) {
+	events := make(chan lib.Event, 10)
+	w := &partyWatcher{
+		onJoin: func(p lib.Party) { events <- lib.Event{Type: lib.EventPartyJoined, Party: &p} },
+	}
+	polling := make(chan bool, 1)
+	w.poll = func(ctx context.Context) ([]lib.Party, error) {
+		if w.known == nil {
+			return nil, nil
+		}
+		polling <- true
+		// the reply comes in after the broadcast has ended:
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50)
+		return []lib.Party{{ID: "late"}}, nil
+	}
+	ctx, stopWatching := context.WithCancel(context.Background())
+	var watchers background
+	watchers.Go(func() { w.run(ctx, time.Millisecond) })
+	<-polling
+	stopWatching()
+	watchers.Wait()
+	// the end of the session closes the events, like the SDK does:
+	close(events)
+	for e := range events {
+		if e.Type != lib.EventPartyJoined || e.Party.ID != "late" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+}
+
+func TestPartyNotifier(t *testing.T) {
+	var out bytes.Buffer
+	n := &partyNotifier{mode: NotifyTitle, out: &out}
+	n.joined(lib.Party{RemoteAddr: "10.0.0.1:3022"})
+	if s := out.String(); !strings.HasPrefix(s, "\033]0;Teleconsole: 10.0.0.1:3022 joined at ") {
+		t.Fatalf("unexpected title %q", s)
+	}
+
+	out.Reset()
+	n.mode = NotifyNone
+	n.left(lib.Party{RemoteAddr: "10.0.0.1:3022"})
+	n.clear()
+	if out.Len() != 0 {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
@@ -2,12 +2,14 @@ package conf
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gravitational/teleconsole/lib"
 	"github.com/gravitational/teleport/lib/client"
@@ -39,13 +41,89 @@ type Config struct {
 	// Ports to forward
 	ForwardPorts []client.ForwardedPort
 
-	// Forward-by-invite:
-	ForwardPort *client.ForwardedPort
+	// Forward-by-invite (-f flag, can be repeated):
+	PortInvites []*lib.PortInvite
+
+	// PortMappings define local addresses for accepted invites when
+	// joining (-map flag, can be repeated)
+	PortMappings []*lib.PortMapping
+
+	// RemoteForwards expose joining party's ports on the broadcaster's
+	// machine (-R flag, can be repeated)
+	RemoteForwards []*lib.RemoteForward
+
+	// SOCKSAllowList (if set) enables the SOCKS proxy for joining parties
+	// and limits where they can go through it (-socks flag)
+	SOCKSAllowList lib.SOCKSAllowList
+
+	// DynamicForwards are local addresses of SOCKS proxies leading through
+	// the broadcaster's machine (-D flag when joining, can be repeated)
+	DynamicForwards []string
+
+	// Observers enables the read-only invite
+	Observers bool
+
+	// RecordFile (if set) is where the session is recorded to in asciicast
+	// format
+	RecordFile string
 
 	// IdentityFile contains a full file path of the SSH key file to use.
 	// For "start session" it points to a public key, but for "join" it
 	// points to a private key.
 	IdentityFile string
+
+	// PINProtected (-pin flag) protects the broadcast with a PIN which is
+	// asked for when the broadcast starts
+	PINProtected bool
+
+	// Notify (-notify flag) defines how the broadcaster learns about
+	// parties joining and leaving: "title", "line" or "none"
+	Notify string
+
+	// Approve (-approve flag) makes the broadcaster approve every party
+	// before they can join
+	Approve bool
+
+	// Name (-name flag) is the display name a joining party announces
+	// to the broadcaster
+	Name string
+
+	// PIN of the session. Broadcasting with a PIN set implies -pin, joining
+	// parties are asked for it if it is not set
+	PIN string
+
+	// Stdin and Stdout (if set) are used for the shared shell instead of
+	// the terminal. This is how tests drive sessions
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	// Events (-output json) receives machine-readable events about the
+	// session as JSON lines
+	Events io.Writer
+
+	// OnEvent (if set) is called for every event about the session. This
+	// is how programs embedding Teleconsole follow it
+	OnEvent func(lib.Event)
+
+	// APITimeout (-timeout flag) limits every request to the Teleconsole
+	// server, DefaultAPITimeout is used if it is not set
+	APITimeout time.Duration
+
+	// SetupTimeout (-setup-timeout flag) limits how long it takes to set
+	// up a broadcast, DefaultSetupTimeout is used if it is not set
+	SetupTimeout time.Duration
+
+	// MessageOut receives the messages for humans, os.Stdout is used
+	// if it is not set
+	MessageOut io.Writer
+
+	// GithubAPI (-github-api flag or "github_api" in the config file) is
+	// the base URL of GitHub API, for GitHub Enterprise
+	GithubAPI string
+
+	// GithubToken ("github_token" in the config file or GITHUB_TOKEN) lets
+	// -i @org/team see the members of organizations and teams
+	GithubToken string
 }
 
 // Get() returns Teleconsole configuration: default values overwritten
@@ -74,6 +152,8 @@ func Get() (c *Config, err error) {
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	c.GithubAPI = i.Get("", "github_api")
+	c.GithubToken = i.GetOrDefault("", "github_token", os.Getenv("GITHUB_TOKEN"))
 	return c, nil
 }
 
@@ -95,6 +175,30 @@ func (this *Config) SetEndpointHost(hostPort string) (err error) {
 	return trace.Wrap(err)
 }
 
+// GetAPITimeout returns the timeout of requests to the Teleconsole server
+func (this *Config) GetAPITimeout() time.Duration {
+	if this.APITimeout <= 0 {
+		return DefaultAPITimeout
+	}
+	return this.APITimeout
+}
+
+// GetSetupTimeout returns how long it may take to set up a broadcast
+func (this *Config) GetSetupTimeout() time.Duration {
+	if this.SetupTimeout <= 0 {
+		return DefaultSetupTimeout
+	}
+	return this.SetupTimeout
+}
+
+// GetMessageOut returns where the messages for humans go
+func (this *Config) GetMessageOut() io.Writer {
+	if this.MessageOut == nil {
+		return os.Stdout
+	}
+	return this.MessageOut
+}
+
 // GetEndpointHost returns the hostname of the Teleconsole server endpoint
 // (without port)
 func (this *Config) GetEndpointHost() string {
@@ -1,7 +1,16 @@
 package conf
 
+import "time"
+
 const (
 	DefaultConfigFileName = ".teleconsolerc"
 	DefaultServerHost     = "teleconsole.com"
 	DefaultServerPort     = "443"
+
+	// DefaultAPITimeout limits every request to the Teleconsole server
+	DefaultAPITimeout = time.Second * 30
+
+	// DefaultSetupTimeout limits how long it takes for a new broadcast
+	// to get through to the Teleconsole server
+	DefaultSetupTimeout = time.Minute
 )
@@ -1,6 +1,7 @@
 package geo
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,6 +17,9 @@ type Endpoint struct {
 	SessionPrefix string `json:"session_prefix"`
 }
 
+// PingTimeout is how long FindFastestEndpoint waits for the servers
+var PingTimeout = time.Second * 5
+
 var (
 	// US West is the default:
 	DefaultEndpoint = Endpoint{Hostname: conf.DefaultServerHost, SessionPrefix: ""}
@@ -29,16 +33,25 @@ var (
 )
 
 // FindFastestEndpoint returns the Teleconsole server endpoint which was
-// the fastest to respond to HTTP ping/pong
-func FindFastestEndpoint() Endpoint {
-	responded := make(chan Endpoint)
+// the fastest to respond to HTTP ping/pong. The default endpoint is
+// returned if none responds in time or 'ctx' is done
+func FindFastestEndpoint(ctx context.Context) Endpoint {
+	responded := make(chan Endpoint, len(Endpoints))
 	start := time.Now()
+	// the slower pings are cancelled:
+	ctx, cancel := context.WithTimeout(ctx, PingTimeout)
+	defer cancel()
 
 	// performs HTTP GET against a given endpoint
 	ping := func(ep Endpoint) {
 		url := fmt.Sprintf("http://%s/ping", ep.Hostname)
 		log.Infof("Ping %s", url)
-		resp, err := http.Get(url)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 		if err != nil {
 			log.Error(err)
 			return
@@ -51,14 +64,11 @@ func FindFastestEndpoint() Endpoint {
 	for _, ep := range Endpoints {
 		go ping(ep)
 	}
-	timeout := time.NewTimer(time.Second * 5)
-	defer timeout.Stop()
-
 	select {
 	case e := <-responded:
 		log.Infof("%s responded in %v", e.Hostname, time.Now().Sub(start))
 		return e
-	case <-timeout.C:
+	case <-ctx.Done():
 		log.Error("Timeout: none of the severs have played pong.")
 	}
 	return DefaultEndpoint
@@ -1,8 +1,9 @@
 package geo
 
 import (
-	"os"
+	"context"
 	"testing"
+	"time"
 )
 
 var prefixes = map[string]string{
@@ -49,3 +50,15 @@ func TestGeoCheck(t *testing.T) {
 		t.Errorf("failed to detect non-geo session")
 	}
 }
+
+func TestFindFastestEndpointCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if ep := FindFastestEndpoint(ctx); ep != DefaultEndpoint {
+		t.Fatalf("expected the default endpoint, got %v", ep)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("cancelled search has taken %v", time.Since(start))
+	}
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/gravitational/trace"
+)
+
+// Agent is a connection to the user's ssh-agent. The agent signs with its
+// keys, their private halves are never read
+type Agent struct {
+	agent.Agent
+	conn net.Conn
+}
+
+// ConnectAgent connects to the ssh-agent listening on SSH_AUTH_SOCK. Returns
+// trace.NotFound if there is no agent
+func ConnectAgent() (*Agent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, trace.NotFound("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, trace.ConnectionProblem(err, "failed to connect to ssh-agent at %v", sock)
+	}
+	return &Agent{Agent: agent.NewClient(conn), conn: conn}, nil
+}
+
+// SignerFor returns the agent's signer for the authorized_keys-formatted
+// public key, or nil if the agent doesn't have the key
+func (this *Agent) SignerFor(authorized []byte) ssh.Signer {
+	signers, err := this.Signers()
+	if err != nil {
+		return nil
+	}
+	for _, s := range signers {
+		if KeyMatches(authorized, s.PublicKey()) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the agent
+func (this *Agent) Close() error {
+	return this.conn.Close()
+}
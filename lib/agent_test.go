@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startAgent serves an ssh-agent with the keys on SSH_AUTH_SOCK. Returns a
+// function which stops it
+func startAgent(t *testing.T, keys ...interface{}) func() {
+	dir, err := ioutil.TempDir("", "teleconsole-agent-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	for _, k := range keys {
+		if err = keyring.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	prev := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	return func() {
+		os.Setenv("SSH_AUTH_SOCK", prev)
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	data, err := ioutil.ReadFile("../fixtures/ids/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer startAgent(t, priv)()
+
+	keys, err := ConnectAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	one, _ := ioutil.ReadFile("../fixtures/ids/one.pub")
+	signer := keys.SignerFor(one)
+	if signer == nil {
+		t.Fatal("the agent's key is not found")
+	}
+	sig, err := signer.Sign(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, _ := ssh.ParseAuthorizedKey(one)
+	if err = pub.Verify([]byte("hello"), sig); err != nil {
+		t.Fatal(err)
+	}
+	two, _ := ioutil.ReadFile("../fixtures/ids/two.pub")
+	if keys.SignerFor(two) != nil {
+		t.Fatal("the agent does not have this key")
+	}
+}
+
+func TestNoAgent(t *testing.T) {
+	prev := os.Getenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", prev)
+	os.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := ConnectAgent(); err == nil {
+		t.Fatal("there's no agent to connect to")
+	}
+}
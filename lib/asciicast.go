@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// asciicast v2 event types
+const (
+	CastOutput = "o"
+	CastInput  = "i"
+	CastResize = "r"
+)
+
+// CastHeader is the first line of an asciicast v2 file.
+// See https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// CastWriter records terminal output into asciicast v2 format. It is an
+// io.Writer, so it can be attached to the output of a shell
+type CastWriter struct {
+	sync.Mutex
+	w       io.Writer
+	clock   clockwork.Clock
+	start   time.Time
+	partial []byte
+	err     error
+}
+
+// NewCastWriter writes the asciicast header for a terminal of a given size
+// and returns a writer for the terminal output
+func NewCastWriter(w io.Writer, width, height int) (*CastWriter, error) {
+	return newCastWriter(w, width, height, clockwork.NewRealClock())
+}
+
+func newCastWriter(w io.Writer, width, height int, clock clockwork.Clock) (*CastWriter, error) {
+	this := &CastWriter{
+		w:     w,
+		clock: clock,
+		start: clock.Now(),
+	}
+	header := CastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: this.start.Unix(),
+		Env: map[string]string{
+			"SHELL": os.Getenv("SHELL"),
+			"TERM":  os.Getenv("TERM"),
+		},
+	}
+	bytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if _, err = fmt.Fprintf(w, "%s\n", bytes); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return this, nil
+}
+
+// Write records a chunk of terminal output. Multi-byte characters split
+// between writes are held back until they're complete, because asciicast
+// events must be valid UTF-8
+func (this *CastWriter) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	data := append(this.partial, p...)
+	// find where the last complete rune ends:
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	this.partial = append([]byte{}, data[cut:]...)
+	if cut > 0 {
+		this.writeEvent(CastOutput, string(data[:cut]))
+	}
+	return len(p), this.err
+}
+
+// Resize records the change of the terminal size
+func (this *CastWriter) Resize(width, height int) error {
+	this.Lock()
+	defer this.Unlock()
+	this.writeEvent(CastResize, fmt.Sprintf("%dx%d", width, height))
+	return this.err
+}
+
+// Close flushes the incomplete output (if any)
+func (this *CastWriter) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	if len(this.partial) > 0 {
+		this.writeEvent(CastOutput, string(this.partial))
+		this.partial = nil
+	}
+	return this.err
+}
+
+// writeEvent appends [time, type, data] line to the recording. The first
+// error sticks and stops the recording
+func (this *CastWriter) writeEvent(kind, data string) {
+	if this.err != nil {
+		return
+	}
+	elapsed := this.clock.Now().Sub(this.start).Seconds()
+	bytes, err := json.Marshal([]interface{}{elapsed, kind, data})
+	if err != nil {
+		this.err = trace.Wrap(err)
+		return
+	}
+	if _, err = fmt.Fprintf(this.w, "%s\n", bytes); err != nil {
+		this.err = trace.Wrap(err)
+	}
+}
+
+// CastEvent is a single event of an asciicast recording
+type CastEvent struct {
+	// Time is the number of seconds since the beginning of the recording
+	Time float64
+	// Type is one of CastOutput, CastInput or CastResize
+	Type string
+	Data string
+}
+
+// ReadCast parses an asciicast v2 recording
+func ReadCast(r io.Reader) (*CastHeader, []CastEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, nil, trace.Wrap(scanner.Err())
+		}
+		return nil, nil, trace.BadParameter("empty recording")
+	}
+	var header CastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, trace.BadParameter("not an asciicast file: %v", err)
+	}
+	if header.Version != 2 {
+		return nil, nil, trace.BadParameter("unsupported asciicast version %d", header.Version)
+	}
+	var events []CastEvent
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var raw []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			return nil, nil, trace.BadParameter("line %d: %v", line, err)
+		}
+		var (
+			e   CastEvent
+			ok  bool
+			bad = len(raw) != 3
+		)
+		if !bad {
+			e.Time, ok = raw[0].(float64)
+			bad = bad || !ok
+			e.Type, ok = raw[1].(string)
+			bad = bad || !ok
+			e.Data, ok = raw[2].(string)
+			bad = bad || !ok
+		}
+		if bad {
+			return nil, nil, trace.BadParameter("line %d: malformed event", line)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return &header, events, nil
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestCastWriter(t *testing.T) {
+	var buf bytes.Buffer
+	clock := clockwork.NewFakeClock()
+	w, err := newCastWriter(&buf, 80, 25, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 1500)
+	w.Write([]byte("hello\r\n"))
+	// "ж" is two bytes, split between two writes:
+	clock.Advance(time.Second)
+	w.Write([]byte{'a', 0xd0})
+	w.Write([]byte{0xb6})
+	w.Resize(100, 40)
+	w.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected header and 4 events, got:\n%s", buf.String())
+	}
+	var header CastHeader
+	if err = json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 25 {
+		t.Fatalf("bad header: %+v", header)
+	}
+	expected := []struct {
+		time float64
+		kind string
+		data string
+	}{
+		{1.5, CastOutput, "hello\r\n"},
+		{2.5, CastOutput, "a"},
+		{2.5, CastOutput, "ж"},
+		{2.5, CastResize, "100x40"},
+	}
+	for i, e := range expected {
+		var event []interface{}
+		if err = json.Unmarshal([]byte(lines[i+1]), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event[0].(float64) != e.time || event[1].(string) != e.kind || event[2].(string) != e.data {
+			t.Fatalf("event %d: expected %v, got %v", i, e, event)
+		}
+	}
+}
+
+func TestReadCast(t *testing.T) {
+	const recording = `{"version": 2, "width": 100, "height": 30}
+[0.5, "o", "hello"]
+
+[1.25, "r", "120x40"]
+`
+	header, events, err := ReadCast(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 100 || header.Height != 30 {
+		t.Fatalf("bad header: %+v", header)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+	if events[1] != (CastEvent{Time: 1.25, Type: CastResize, Data: "120x40"}) {
+		t.Fatalf("bad event: %+v", events[1])
+	}
+
+	for _, bad := range []string{
+		"",
+		`{"version": 1}`,
+		`{"version": 2}` + "\n[1, \"o\"]",
+		`{"version": 2}` + "\nnot json",
+	} {
+		if _, _, err = ReadCast(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected to fail on %q", bad)
+		}
+	}
+}
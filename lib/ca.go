@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth/native"
+	"github.com/gravitational/teleport/lib/client"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// TrustedCA lets anyone holding an OpenSSH user certificate signed by the CA
+// join the session. The server checks their certificate and lets them log
+// in as Login
+type TrustedCA struct {
+	// Key is the public key of the CA in authorized_keys format
+	Key string `json:"key"`
+
+	// Principals (if set) only admit certificates issued for one of them
+	Principals []string `json:"principals,omitempty"`
+
+	// Login is the session user certified parties log in as
+	Login string `json:"login"`
+}
+
+// loginFromCA makes the session user for parties certified by the CA in
+// "ca:" identity sources: "/path/user_ca.pub" or "/path/user_ca.pub#alice+bob"
+// to only admit certificates for principals "alice" or "bob". The user gets a
+// throw-away key nobody has: parties log in with their own keys certified by
+// the server
+func loginFromCA(spec string) (*sshLogin, *TrustedCA, error) {
+	fp, principals := spec, ""
+	if i := strings.LastIndex(spec, "#"); i >= 0 {
+		fp, principals = spec[:i], spec[i+1:]
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	keys, err := parseAuthorizedKeys(data, fp)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	if len(keys) != 1 {
+		return nil, nil, trace.BadParameter("%v must have one CA key, not %d", fp, len(keys))
+	}
+	_, pub, err := native.New().GenerateKeyPair("")
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	login := &sshLogin{
+		Username: strings.TrimSuffix(filepath.Base(fp), ".pub"),
+		Key:      &client.Key{Pub: pub},
+	}
+	ca := &TrustedCA{
+		Key:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keys[0]))),
+		Login: login.Username,
+	}
+	for _, p := range strings.Split(principals, "+") {
+		if p = strings.TrimSpace(p); p != "" {
+			ca.Principals = append(ca.Principals, p)
+		}
+	}
+	return login, ca, nil
+}
+
+// Check returns nil if the certificate is a valid user certificate signed by
+// the CA for one of its principals
+func (this *TrustedCA) Check(cert *ssh.Certificate, now time.Time) error {
+	caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(this.Key))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if cert.CertType != ssh.UserCert {
+		return trace.AccessDenied("not a user certificate")
+	}
+	// the server doesn't see where parties connect from in the end:
+	if _, ok := cert.CriticalOptions["source-address"]; ok {
+		return trace.AccessDenied("certificates limited to source addresses are not supported")
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return KeyMatches(ssh.MarshalAuthorizedKey(auth), caKey)
+		},
+		Clock: func() time.Time { return now },
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return trace.AccessDenied("the certificate is not signed by the session CA")
+	}
+	// CheckCert verifies the signature, the validity period and the
+	// principal (if the certificate is limited to some)
+	principals := this.Principals
+	if len(principals) == 0 {
+		principals = append([]string{""}, cert.ValidPrincipals...)
+	} else if len(cert.ValidPrincipals) == 0 {
+		// certificates with no principals are valid for anyone, but this
+		// CA only admits some:
+		return trace.AccessDenied("the certificate has no principals")
+	}
+	for _, p := range principals {
+		if err = checker.CheckCert(p, cert); err == nil {
+			return nil
+		}
+	}
+	return trace.AccessDenied("invalid certificate: %v", err)
+}
+
+// CertRequest asks the server to let the holder of an OpenSSH certificate
+// signed by a trusted CA into the session
+type CertRequest struct {
+	// Cert is the OpenSSH certificate in authorized_keys format
+	Cert string `json:"cert"`
+
+	// Nonce is issued by the server for this request only, so the request
+	// can't be replayed
+	Nonce string `json:"nonce"`
+
+	// Signature proves the possession of the certified key
+	Signature *ssh.Signature `json:"signature"`
+}
+
+// CertChallenge is the nonce the server issues for a certificate request
+type CertChallenge struct {
+	Nonce string `json:"nonce"`
+}
+
+// CertReply is the session user the certified party logs in as, with a
+// certificate for their key
+type CertReply struct {
+	Username      string   `json:"username"`
+	AllowedLogins []string `json:"allowed_logins"`
+
+	// Cert is the Teleport certificate for the key in authorized_keys format
+	Cert string `json:"cert"`
+}
+
+// certPayload returns the data a certificate request signature is made over
+func certPayload(sessionID, nonce, cert string) []byte {
+	return []byte("teleconsole-cert\x00" + sessionID + "\x00" + nonce + "\x00" + cert)
+}
+
+// Sign makes a request to join the session with the certificate, using the
+// nonce issued by the server. 'signer' signs with the certified key
+func (this *CertRequest) Sign(sessionID, nonce string, cert *ssh.Certificate, signer ssh.Signer) error {
+	this.Cert = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+	this.Nonce = nonce
+	sig, err := signer.Sign(rand.Reader, certPayload(sessionID, nonce, this.Cert))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	this.Signature = sig
+	return nil
+}
+
+// Verify checks the signature of the request and returns its certificate.
+// Neither the certificate itself nor the nonce are checked
+func (this *CertRequest) Verify(sessionID string) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(this.Cert))
+	if err != nil {
+		return nil, trace.BadParameter("malformed certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, trace.BadParameter("not a certificate")
+	}
+	if this.Signature == nil {
+		return nil, trace.BadParameter("certificate request is not signed")
+	}
+	if err = cert.Key.Verify(certPayload(sessionID, this.Nonce, this.Cert), this.Signature); err != nil {
+		return nil, trace.AccessDenied("certificate request signature does not match its key")
+	}
+	return cert, nil
+}
+
+// certifiedSigner signs with a certified key, but presents the key itself
+// instead of the certificate (like signers of ssh-agent's certificates)
+type certifiedSigner struct {
+	ssh.Signer
+	cert *ssh.Certificate
+}
+
+func (this *certifiedSigner) PublicKey() ssh.PublicKey {
+	return this.cert.Key
+}
+
+// CertifiedSigner returns a signer for the key of the certificate, made out
+// of a signer for either the key or the certificate
+func CertifiedSigner(cert *ssh.Certificate, signer ssh.Signer) ssh.Signer {
+	if _, ok := signer.PublicKey().(*ssh.Certificate); ok {
+		return &certifiedSigner{Signer: signer, cert: cert}
+	}
+	return signer
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSigner generates an ECDSA key (quick to make)
+func newTestSigner(t *testing.T) ssh.Signer {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestCert certifies the key with the CA for the principals, valid for
+// 'ttl' from now
+func newTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, ttl time.Duration, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(ttl).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTrustedCA(t *testing.T) {
+	ca, other, key := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+
+	dir, err := ioutil.TempDir("", "teleconsole-ca-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "user_ca.pub")
+	if err = ioutil.WriteFile(fp, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := MakeIdentity("ca:" + fp + "#ops+dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(i.Logins) != 1 || len(i.CAs) != 1 || i.Logins[0].Username != "user_ca" {
+		t.Fatalf("expected one login and CA, got %+v", i)
+	}
+	principals := i.CAs[0]
+	if principals.Login != "user_ca" || len(principals.Principals) != 2 {
+		t.Fatalf("unexpected CA: %+v", principals)
+	}
+	i, err = MakeIdentity("ca:" + fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anyone := i.CAs[0]
+	if _, err = MakeIdentity("ca:" + filepath.Join(dir, "nothing.pub")); err == nil {
+		t.Fatal("missing CA must fail")
+	}
+
+	hostCert := newTestCert(t, ca, key.PublicKey(), time.Hour, "ops")
+	hostCert.CertType = ssh.HostCert
+	hostCert.SignCert(rand.Reader, ca)
+	limited := newTestCert(t, ca, key.PublicKey(), time.Hour, "ops")
+	limited.CriticalOptions = map[string]string{"source-address": "10.0.0.1"}
+	limited.SignCert(rand.Reader, ca)
+
+	now := time.Now()
+	testCases := []struct {
+		name  string
+		ca    TrustedCA
+		cert  *ssh.Certificate
+		valid bool
+	}{
+		{name: "principal", ca: principals, cert: newTestCert(t, ca, key.PublicKey(), time.Hour, "dev"), valid: true},
+		{name: "any principal", ca: anyone, cert: newTestCert(t, ca, key.PublicKey(), time.Hour, "alice"), valid: true},
+		{name: "no principals", ca: anyone, cert: newTestCert(t, ca, key.PublicKey(), time.Hour), valid: true},
+		{name: "no principals for a limited CA", ca: principals, cert: newTestCert(t, ca, key.PublicKey(), time.Hour)},
+		{name: "other principal", ca: principals, cert: newTestCert(t, ca, key.PublicKey(), time.Hour, "alice")},
+		{name: "expired", ca: anyone, cert: newTestCert(t, ca, key.PublicKey(), -time.Second, "ops")},
+		{name: "other CA", ca: anyone, cert: newTestCert(t, other, key.PublicKey(), time.Hour, "ops")},
+		{name: "host certificate", ca: anyone, cert: hostCert},
+		{name: "source address", ca: anyone, cert: limited},
+	}
+	for _, tc := range testCases {
+		err := tc.ca.Check(tc.cert, now)
+		if tc.valid && err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("%s: must be rejected", tc.name)
+		}
+	}
+}
+
+func TestCertRequest(t *testing.T) {
+	ca, key, other := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	cert := newTestCert(t, ca, key.PublicKey(), time.Hour, "ops")
+
+	var req CertRequest
+	if err := req.Sign("sid", "nonce", cert, key); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := req.Verify("sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !KeyMatches(ssh.MarshalAuthorizedKey(verified.Key), key.PublicKey()) {
+		t.Fatal("the request must carry the certificate")
+	}
+	// requests are only good for the session they're made for:
+	if _, err = req.Verify("other"); err == nil {
+		t.Fatal("the request for another session must be rejected")
+	}
+	// the nonce is signed too:
+	forged := req
+	forged.Nonce = "another nonce"
+	if _, err = forged.Verify("sid"); err == nil {
+		t.Fatal("the request with another nonce must be rejected")
+	}
+	// only the holder of the certified key can make them:
+	if err = req.Sign("sid", "nonce", cert, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.Verify("sid"); err == nil {
+		t.Fatal("the request signed with another key must be rejected")
+	}
+
+	// ssh-agent's signers present the certificate, not the key:
+	certSigner, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := CertifiedSigner(cert, certSigner)
+	if !KeyMatches(ssh.MarshalAuthorizedKey(signer.PublicKey()), key.PublicKey()) {
+		t.Fatal("the signer must present the certified key")
+	}
+	if CertifiedSigner(cert, key) != key {
+		t.Fatal("signers of the key must be used as they are")
+	}
+}
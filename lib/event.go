@@ -0,0 +1,35 @@
+package lib
+
+import "time"
+
+// Types of session events
+const (
+	EventSessionCreated = "session_created"
+	EventSessionJoined  = "session_joined"
+	EventPartyJoined    = "party_joined"
+	EventPartyLeft      = "party_left"
+	EventSessionEnded   = "session_ended"
+)
+
+// Event tells what has happened to a session. Events are emitted as JSON
+// lines with -output json and delivered to programs embedding Teleconsole
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// SessionID is the Teleconsole ID joining parties use
+	SessionID string `json:"session_id,omitempty"`
+	// ObserverID is the Teleconsole ID of the read-only invite
+	ObserverID string `json:"observer_id,omitempty"`
+	// WebURL is the address of the session's web UI
+	WebURL string `json:"web_url,omitempty"`
+	// Login is the broadcaster's login (session_joined)
+	Login string `json:"login,omitempty"`
+	// Observer is set if we have joined as an observer (session_joined)
+	Observer bool `json:"observer,omitempty"`
+	// Party who has joined or left
+	Party *Party `json:"party,omitempty"`
+	// ExitCode of the shared command (session_ended)
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Error the session has ended with (session_ended)
+	Error string `json:"error,omitempty"`
+}
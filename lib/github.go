@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// DefaultGithubAPI is the base URL of GitHub API
+const DefaultGithubAPI = "https://api.github.com"
+
+var (
+	// githubAPI is the base URL of GitHub API (GitHub Enterprise has it at
+	// https://host/api/v3)
+	githubAPI = DefaultGithubAPI
+
+	// githubToken authenticates GitHub API requests
+	githubToken string
+)
+
+// ConfigureGithub sets the GitHub API used to find public keys of GitHub
+// users, organizations and teams. Members of teams and private members of
+// organizations are only visible with a token
+func ConfigureGithub(apiURL, token string) {
+	githubAPI = DefaultGithubAPI
+	if apiURL != "" {
+		githubAPI = strings.TrimSuffix(apiURL, "/")
+	}
+	githubToken = token
+}
+
+// loginsFromGithubTeam returns logins for the keys of every member of the
+// GitHub organization ("org") or team ("org/team")
+func loginsFromGithubTeam(spec string) (logins []sshLogin, err error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return nil, trace.BadParameter("invalid GitHub team '@%s', expected @org or @org/team", spec)
+	}
+	next := fmt.Sprintf("%s/orgs/%s/members?per_page=100", githubAPI, url.PathEscape(parts[0]))
+	if len(parts) == 2 {
+		next = fmt.Sprintf("%s/orgs/%s/teams/%s/members?per_page=100",
+			githubAPI, url.PathEscape(parts[0]), url.PathEscape(parts[1]))
+	}
+	var members []string
+	for page := 0; next != "" && page < maxKeysPages; page++ {
+		var users []struct {
+			Login string `json:"login"`
+		}
+		if next, err = githubGet(next, &users); err != nil {
+			return nil, trace.Wrap(err, "failed to get the members of @%s", spec)
+		}
+		for _, u := range users {
+			members = append(members, u.Login)
+		}
+	}
+	if len(members) == 0 {
+		return nil, trace.NotFound("@%s has no members", spec)
+	}
+	for _, m := range members {
+		ml, err := loginsFromGithub(m)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		logins = append(logins, ml...)
+	}
+	return logins, nil
+}
+
+// githubGet GETs the GitHub API URL into 'v'. Returns the URL of the next
+// page of the results, if there is one
+func githubGet(apiURL string, v interface{}) (next string, err error) {
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if githubToken != "" {
+		req.Header.Set("Authorization", "token "+githubToken)
+	}
+	resp, err := keysClient.Do(req)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKeysSize))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e GithubError
+		if json.Unmarshal(bytes, &e) == nil && e.Message != "" {
+			return "", trace.Wrap(e)
+		}
+		return "", trace.Errorf("%s: %s", apiURL, resp.Status)
+	}
+	if err = json.Unmarshal(bytes, v); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return nextLink(resp.Header.Get("Link")), nil
+}
+
+// nextLink returns the URL of the next page from the Link header of
+// paginated GitHub API responses:
+//
+//	Link: <https://api.github.com/...&page=2>; rel="next", <...>; rel="last"
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeGithub serves members of the "acme" organization and its "oncall"
+// team (two pages), and their keys. Teams need the "secret" token
+func fakeGithub(t *testing.T) *httptest.Server {
+	one, err := ioutil.ReadFile("../fixtures/ids/one.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := ioutil.ReadFile("../fixtures/ids/two.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/members", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"login":"alice"}]`)
+	})
+	mux.HandleFunc("/orgs/acme/teams/oncall/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?per_page=100&page=2>; rel="next", <http://%s%s?per_page=100&page=2>; rel="last"`,
+				r.Host, r.URL.Path, r.Host, r.URL.Path))
+			fmt.Fprint(w, `[{"login":"alice"}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"login":"bob"}]`)
+	})
+	mux.HandleFunc("/users/alice/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id":1,"key":%q}]`, strings.TrimSpace(string(one)))
+	})
+	mux.HandleFunc("/users/bob/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id":2,"key":%q},{"id":3,"key":%q}]`,
+			strings.TrimSpace(string(one)), strings.TrimSpace(string(two)))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestGithubTeam(t *testing.T) {
+	server := fakeGithub(t)
+	defer server.Close()
+	defer ConfigureGithub("", "")
+
+	// teams are not visible without the token:
+	ConfigureGithub(server.URL+"/", "")
+	if _, err := MakeIdentity("@acme/oncall"); err == nil {
+		t.Fatal("the team must not be found without the token")
+	}
+
+	ConfigureGithub(server.URL+"/", "secret")
+	i, err := MakeIdentity("@acme/oncall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logins []string
+	for _, l := range i.Logins {
+		logins = append(logins, l.Username)
+		if len(l.Key.Pub) == 0 || len(l.Key.Priv) != 0 {
+			t.Fatalf("%s must have a public key only", l.Username)
+		}
+	}
+	if strings.Join(logins, ",") != "alice0,bob0,bob1" {
+		t.Fatalf("unexpected logins: %v", logins)
+	}
+
+	i, err = MakeIdentity("@acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(i.Logins) != 1 || i.Logins[0].Username != "alice0" {
+		t.Fatalf("unexpected logins: %+v", i.Logins)
+	}
+
+	for _, spec := range []string{"@", "@acme/", "@/oncall", "@acme/oncall/x", "@nobody"} {
+		if _, err = MakeIdentity(spec); err == nil {
+			t.Fatalf("%s must fail", spec)
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	testCases := []struct {
+		header, next string
+	}{
+		{header: "", next: ""},
+		{header: `<https://api.github.com/x?page=3>; rel="next", <https://api.github.com/x?page=5>; rel="last"`,
+			next: "https://api.github.com/x?page=3"},
+		{header: `<https://api.github.com/x?page=1>; rel="prev", <https://api.github.com/x?page=1>; rel="first"`,
+			next: ""},
+	}
+	for _, tc := range testCases {
+		if next := nextLink(tc.header); next != tc.next {
+			t.Fatalf("%q: expected %q, got %q", tc.header, tc.next, next)
+		}
+	}
+}
@@ -1,14 +1,9 @@
 package lib
 
 import (
-	"crypto/dsa"
-	"crypto/ecdsa"
-	"crypto/rsa"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os/user"
 	"path/filepath"
 	"strings"
@@ -47,6 +42,9 @@ type Identity struct {
 	// you to have several. also, a user can specify multiple SSH identities
 	// for a single session, they all go here:
 	Logins []sshLogin `json:"logins"`
+	// CAs admit anyone with a certificate signed by them ("ca:" sources),
+	// each has a login of its own
+	CAs []TrustedCA `json:"cas,omitempty"`
 }
 
 // sshLogin represents SSH credentials (key, really). The username here
@@ -60,11 +58,16 @@ type sshLogin struct {
 // is an empty string, an anonymous identity is created.
 //
 // Otherwise a regular (named) identity is created. A source can be a comma-separated
-// list of values, where each value can be either a file, or a github handle
+// list of values, where each value can be either a file, a github handle,
+// members of a github organization or team (@org or @org/team) or a
+// prefixed public key source: github:user, gitlab:user[@host],
+// bitbucket:user, url:https://... or file:authorized_keys. "ca:user_ca.pub"
+// admits anyone with an OpenSSH certificate signed by the CA
 //
 // Examples:
 //		MakeIdentity("filename")
 //		MakeIdentity('"/home/my name/.ssh/id_rsa",githubuser')
+//		MakeIdentity("gitlab:alice@gitlab.example.com,file:./authorized_keys")
 func MakeIdentity(idPath string) (*Identity, error) {
 	var (
 		err error
@@ -79,7 +82,7 @@ func MakeIdentity(idPath string) (*Identity, error) {
 	if i.Anonymous {
 		i.Logins, err = anonymousLogins()
 	} else {
-		i.Logins, err = loginsFrom(idPath)
+		i.Logins, i.CAs, err = loginsFrom(idPath)
 	}
 	if err != nil {
 		logrus.Error(err)
@@ -124,31 +127,82 @@ func anonymousLogins() ([]sshLogin, error) {
 	}, nil
 }
 
-// loginsFrom generates SSH logins from the given identity sources
-func loginsFrom(idSources string) (logins []sshLogin, err error) {
+// loginsFrom generates SSH logins and trusted CAs from the given identity
+// sources
+func loginsFrom(idSources string) (logins []sshLogin, cas []TrustedCA, err error) {
 	r := csv.NewReader(strings.NewReader(idSources))
 	fields, err := r.ReadAll()
 	if err != nil || len(fields) != 1 {
-		return nil, trace.Wrap(err, "Failed parsing identity source: '%s'", idSources)
+		return nil, nil, trace.Wrap(err, "Failed parsing identity source: '%s'", idSources)
 	}
+	// caLogins are the indexes of the logins of 'cas'
+	var caLogins []int
 	for _, idSrc := range fields[0] {
+		// certificate authority (ca:/path/user_ca.pub#principals)
+		if strings.HasPrefix(idSrc, "ca:") {
+			login, ca, err := loginFromCA(strings.TrimPrefix(idSrc, "ca:"))
+			if err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			caLogins = append(caLogins, len(logins))
+			logins = append(logins, *login)
+			cas = append(cas, *ca)
+			continue
+		}
+		// members of a GitHub organization or team (@org or @org/team)
+		if strings.HasPrefix(idSrc, "@") {
+			tl, err := loginsFromGithubTeam(idSrc[1:])
+			if err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			logins = append(logins, tl...)
+			continue
+		}
+		// prefixed public key source (gitlab:user, url:https://..., etc)
+		if source, value := prefixedSource(idSrc); source != nil {
+			sl, err := source(value)
+			if err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			logins = append(logins, sl...)
+			continue
+		}
 		// identity file (SSH private key)
 		if utils.IsFile(idSrc) {
-			login, err := loginFromFile(idSrc)
+			load := loginFromFile
+			if isEncryptedKeyFile(idSrc) {
+				load = publicLoginFromFile
+			}
+			login, err := load(idSrc)
 			if err != nil {
-				return nil, trace.Wrap(err)
+				return nil, nil, trace.Wrap(err)
 			}
 			logins = append(logins, *login)
 		} else {
 			// github user:
 			gl, err := loginsFromGithub(idSrc)
 			if err != nil {
-				return nil, trace.Wrap(err)
+				return nil, nil, trace.Wrap(err)
 			}
 			logins = append(logins, gl...)
 		}
 	}
-	return logins, nil
+	// every source names its logins after the user (or the file, or the
+	// host), the same name from two sources must not make one replace the
+	// other:
+	taken := make(map[string]bool)
+	for i := range logins {
+		name := logins[i].Username
+		for n := 1; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", logins[i].Username, n)
+		}
+		taken[name] = true
+		logins[i].Username = name
+	}
+	for c, i := range caLogins {
+		cas[c].Login = logins[i].Username
+	}
+	return logins, cas, nil
 }
 
 func loginsFromGithub(username string) (logins []sshLogin, err error) {
@@ -168,36 +222,34 @@ func loginsFromGithub(username string) (logins []sshLogin, err error) {
 	return logins, nil
 }
 
+// loginFromFile makes a login from an SSH private key file, asking for its
+// passphrase if it's encrypted
 func loginFromFile(fp string) (*sshLogin, error) {
-	bytes, err := ioutil.ReadFile(fp)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-	// parse the private key:
-	p, err := ssh.ParseRawPrivateKey(bytes)
+	priv, signer, err := ReadPrivateKey(fp)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	// derive the public key from the private one:
-	var pubKey ssh.PublicKey = nil
-	switch pk := p.(type) {
-	case *rsa.PrivateKey:
-		pubKey, err = ssh.NewPublicKey(&pk.PublicKey)
-	case *dsa.PrivateKey:
-		pubKey, err = ssh.NewPublicKey(&pk.PublicKey)
-	case *ecdsa.PrivateKey:
-		pubKey, err = ssh.NewPublicKey(&pk.PublicKey)
-	default:
-		return nil, trace.Errorf("Unsupported SSH key format")
-	}
+	return &sshLogin{
+		Username: filepath.Base(fp),
+		Key: &client.Key{
+			Pub:  ssh.MarshalAuthorizedKey(signer.PublicKey()),
+			Priv: priv,
+		},
+	}, nil
+}
+
+// publicLoginFromFile makes a login with only the public key of an SSH key
+// file. Broadcasters never need private keys of named identities, so they
+// aren't asked for passphrases of encrypted ones
+func publicLoginFromFile(fp string) (*sshLogin, error) {
+	pub, err := ReadPublicKey(fp)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return &sshLogin{
 		Username: filepath.Base(fp),
 		Key: &client.Key{
-			Pub:  ssh.MarshalAuthorizedKey(pubKey),
-			Priv: bytes,
+			Pub: ssh.MarshalAuthorizedKey(pub),
 		},
 	}, nil
 }
@@ -216,30 +268,31 @@ func (this GithubError) Error() string {
 }
 
 func githubKeysFor(username string) ([]GithubKey, error) {
-	var hc http.Client
-	resp, err := hc.Get(fmt.Sprintf("https://api.github.com/users/%s/keys", username))
-	if err != nil {
+	var keys []GithubKey
+	if _, err := githubGet(fmt.Sprintf("%s/users/%s/keys", githubAPI, username), &keys); err != nil {
 		return nil, trace.Wrap(err)
 	}
-	defer resp.Body.Close()
+	return keys, nil
+}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
+const (
+	// ObserverLogin is the only login of read-only observers. There's no
+	// such user on the broadcaster's machine: the broadcaster's SSH server
+	// does not accept it, only the mirror does
+	ObserverLogin = "teleconsole-observer"
 
-	if resp.StatusCode != http.StatusOK {
-		var e GithubError
-		if json.Unmarshal(bytes, &e) == nil {
-			return nil, trace.Wrap(e)
-		}
-	}
+	// observerPrefix starts the names of the users observers log in as
+	observerPrefix = "observer-"
+)
 
-	var keys []GithubKey
-	if err = json.Unmarshal(bytes, &keys); err != nil {
-		return nil, trace.Wrap(err)
-	}
-	return keys, nil
+// IsObserver returns true if the session user is for read-only observers
+func IsObserver(username string) bool {
+	return strings.HasPrefix(username, observerPrefix)
+}
+
+// ObserverName returns the name of the observer user for the session user
+func ObserverName(username string) string {
+	return observerPrefix + username
 }
 
 type UserMap map[string]*integration.User
@@ -278,6 +331,42 @@ func (this *Identity) AnnounceUsers() UserMap {
 	return users
 }
 
+// ObserverUsers returns Teleport users for read-only observers: one for
+// every login, allowed to log in as ObserverLogin only. Observers of
+// anonymous identities get keys of their own, so they never learn the keys
+// of the shared shell
+func (this *Identity) ObserverUsers() (UserMap, error) {
+	m := make(UserMap)
+	for _, login := range this.Logins {
+		key := &client.Key{Pub: login.Key.Pub}
+		if this.Anonymous {
+			priv, pub, err := native.New().GenerateKeyPair("")
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key = &client.Key{Pub: pub, Priv: priv}
+		}
+		name := ObserverName(login.Username)
+		m[name] = &integration.User{
+			Username:      name,
+			Key:           key,
+			AllowedLogins: []string{ObserverLogin},
+		}
+	}
+	return m, nil
+}
+
+// Without returns the users except the ones 'skip' returns true for
+func (this UserMap) Without(skip func(username string) bool) UserMap {
+	m := make(UserMap)
+	for name, u := range this {
+		if !skip(name) {
+			m[name] = u
+		}
+	}
+	return m
+}
+
 func (this *Identity) ToJSON() string {
 	b, err := json.MarshalIndent(this, "", "  ")
 	if err != nil {
@@ -120,3 +120,33 @@ func TestNamedIdentity(t *testing.T) {
 		}
 	}
 }
+
+func TestObserverUsers(t *testing.T) {
+	i, err := MakeIdentity("../fixtures/ids/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observers, err := i.ObserverUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := observers[ObserverName("one")]
+	if o == nil || len(observers) != 1 {
+		t.Fatalf("expected an observer user for 'one', got %v", observers)
+	}
+	// observers can only log into the mirror:
+	if len(o.AllowedLogins) != 1 || o.AllowedLogins[0] != ObserverLogin {
+		t.Fatalf("bad observer logins: %v", o.AllowedLogins)
+	}
+	if len(o.Key.Priv) != 0 {
+		t.Fatal("private keys must never be exposed")
+	}
+	users := i.AnnounceUsers()
+	for name, u := range observers {
+		users[name] = u
+	}
+	users = users.Without(IsObserver)
+	if len(users) != 1 || users["one"] == nil {
+		t.Fatalf("observers must be left out: %v", users)
+	}
+}
@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// passphraseAttempts is how many times the user may mistype the
+	// passphrase of a private key
+	passphraseAttempts = 3
+
+	opensshKeyType  = "OPENSSH PRIVATE KEY"
+	opensshKeyMagic = "openssh-key-v1\x00"
+)
+
+// PassphrasePrompt asks for the passphrase of an encrypted private key file.
+// Programs which don't want teleconsole to read the terminal can replace it
+var PassphrasePrompt = func(fp string) (string, error) {
+	return ReadPassword(fmt.Sprintf("Enter passphrase for %s: ", fp))
+}
+
+// decryptedKeys remembers keys the user has typed the passphrase for, so
+// they're asked once per file. They're kept in memory until
+// ForgetDecryptedKeys is called
+var decryptedKeys = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: make(map[string][]byte)}
+
+// ForgetDecryptedKeys drops the decrypted private keys ReadPrivateKey has
+// remembered. Their passphrases are asked for again next time. Programs
+// which outlive their sessions should call it once they're over
+func ForgetDecryptedKeys() {
+	decryptedKeys.Lock()
+	defer decryptedKeys.Unlock()
+	decryptedKeys.m = make(map[string][]byte)
+}
+
+// ReadPrivateKey reads the SSH private key file, asking for its passphrase if
+// the key is encrypted. Returns the key as unencrypted PEM (which is what
+// Teleport can use) and a signer for it
+func ReadPrivateKey(fp string) ([]byte, ssh.Signer, error) {
+	decryptedKeys.Lock()
+	defer decryptedKeys.Unlock()
+	data, ok := decryptedKeys.m[fp]
+	if !ok {
+		var err error
+		if data, err = ioutil.ReadFile(fp); err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+		if isEncryptedKey(data) {
+			if data, err = decryptKeyFile(fp, data); err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			decryptedKeys.m[fp] = data
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "failed to parse %v", fp)
+	}
+	return data, signer, nil
+}
+
+// ReadPublicKey returns the public key of the SSH private key file without
+// asking for a passphrase: it comes from the .pub file next to it or from
+// the private key itself when it is not encrypted
+func ReadPublicKey(fp string) (ssh.PublicKey, error) {
+	if data, err := ioutil.ReadFile(fp + ".pub"); err == nil {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err == nil {
+			return pub, nil
+		}
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, trace.BadParameter("%v is not an SSH private key", fp)
+	}
+	// OpenSSH keys keep the public key unencrypted:
+	if block.Type == opensshKeyType {
+		key, err := parseOpenSSHKey(block.Bytes)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		pub, err := ssh.ParsePublicKey(key.PubKey)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return pub, nil
+	}
+	if isEncryptedKey(data) {
+		return nil, trace.NotFound("%v is encrypted and has no %v.pub", fp, fp)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to parse %v", fp)
+	}
+	return signer.PublicKey(), nil
+}
+
+// isEncryptedKey returns true if the PEM-encoded private key needs a
+// passphrase
+func isEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	if block.Type == opensshKeyType {
+		key, err := parseOpenSSHKey(block.Bytes)
+		return err == nil && key.CipherName != "none"
+	}
+	return x509.IsEncryptedPEMBlock(block)
+}
+
+// isEncryptedKeyFile returns true if the private key file needs a passphrase
+func isEncryptedKeyFile(fp string) bool {
+	data, err := ioutil.ReadFile(fp)
+	return err == nil && isEncryptedKey(data)
+}
+
+// decryptKeyFile asks for the passphrase of the encrypted key until it's
+// right or the user runs out of attempts
+func decryptKeyFile(fp string, data []byte) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		passphrase, err := PassphrasePrompt(fp)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if passphrase == "" {
+			return nil, trace.BadParameter("no passphrase for %v", fp)
+		}
+		key, err := decryptKey(data, []byte(passphrase))
+		if err != x509.IncorrectPasswordError {
+			return key, trace.Wrap(err)
+		}
+		if attempt == passphraseAttempts {
+			return nil, trace.AccessDenied("wrong passphrase for %v", fp)
+		}
+	}
+}
+
+// decryptKey decrypts the PEM-encoded private key. Returns
+// x509.IncorrectPasswordError if the passphrase is wrong
+func decryptKey(data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, trace.BadParameter("no private key found")
+	}
+	if block.Type == opensshKeyType {
+		der, err := decryptOpenSSHKey(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: opensshKeyType, Bytes: der}), nil
+	}
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	// a wrong passphrase may still decrypt into something with valid
+	// padding, but not into a valid key:
+	if _, err = ssh.ParseRawPrivateKey(key); err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+	return key, nil
+}
+
+// opensshKey is the container of OpenSSH-format private keys, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+type opensshKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+func parseOpenSSHKey(der []byte) (*opensshKey, error) {
+	if !bytes.HasPrefix(der, []byte(opensshKeyMagic)) {
+		return nil, trace.BadParameter("invalid OpenSSH private key")
+	}
+	var key opensshKey
+	if err := ssh.Unmarshal(der[len(opensshKeyMagic):], &key); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &key, nil
+}
+
+// decryptOpenSSHKey decrypts the private key block of an OpenSSH-format key
+// and returns the key in the same format, unencrypted
+func decryptOpenSSHKey(der, passphrase []byte) ([]byte, error) {
+	key, err := parseOpenSSHKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if key.KdfName != "bcrypt" {
+		return nil, trace.BadParameter("unsupported key derivation function %q", key.KdfName)
+	}
+	var kdfOpts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	if err = ssh.Unmarshal([]byte(key.KdfOpts), &kdfOpts); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var (
+		keyLen int
+		ctr    bool
+	)
+	switch key.CipherName {
+	case "aes128-ctr", "aes192-ctr", "aes256-ctr":
+		ctr = true
+		fallthrough
+	case "aes128-cbc", "aes192-cbc", "aes256-cbc":
+		fmt.Sscanf(key.CipherName, "aes%d", &keyLen)
+		keyLen /= 8
+	default:
+		return nil, trace.BadParameter("unsupported private key cipher %q", key.CipherName)
+	}
+	if len(key.PrivKeyBlock)%aes.BlockSize != 0 {
+		return nil, trace.BadParameter("invalid encrypted private key")
+	}
+	secret, err := bcryptPBKDF(passphrase, kdfOpts.Salt, int(kdfOpts.Rounds), keyLen+aes.BlockSize)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c, err := aes.NewCipher(secret[:keyLen])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	iv := secret[keyLen:]
+	plain := make([]byte, len(key.PrivKeyBlock))
+	if ctr {
+		cipher.NewCTR(c, iv).XORKeyStream(plain, key.PrivKeyBlock)
+	} else {
+		cipher.NewCBCDecrypter(c, iv).CryptBlocks(plain, key.PrivKeyBlock)
+	}
+	// both check ints are the same random number if the passphrase is right:
+	if len(plain) < 8 || !bytes.Equal(plain[0:4], plain[4:8]) {
+		return nil, x509.IncorrectPasswordError
+	}
+	key.CipherName, key.KdfName, key.KdfOpts = "none", "none", ""
+	key.PrivKeyBlock = plain
+	return append([]byte(opensshKeyMagic), ssh.Marshal(*key)...), nil
+}
+
+// bcryptMagic is what bcrypt_pbkdf encrypts, like bcrypt's "OrpheanBeholderScryDoubt"
+var bcryptMagic = []byte("OxychromaticBlowfishSwatDynamite")
+
+// bcryptPBKDF derives a key from the passphrase the way OpenSSH does it for
+// private keys, see https://man.openbsd.org/bcrypt_pbkdf.3
+func bcryptPBKDF(password, salt []byte, rounds, keyLen int) ([]byte, error) {
+	if rounds < 1 || len(salt) == 0 || keyLen < 1 || keyLen > 1024 {
+		return nil, trace.BadParameter("invalid bcrypt_pbkdf parameters")
+	}
+	const blockSize = 32
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+
+	h := sha512.New()
+	h.Write(password)
+	shapass := h.Sum(nil)
+
+	shasalt := make([]byte, 0, sha512.Size)
+	tmp := make([]byte, blockSize)
+	for block := 1; block <= numBlocks; block++ {
+		h.Reset()
+		h.Write(salt)
+		h.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		if err := bcryptHash(tmp, shapass, h.Sum(shasalt)); err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		out := make([]byte, blockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			if err := bcryptHash(tmp, shapass, h.Sum(shasalt)); err != nil {
+				return nil, trace.Wrap(err)
+			}
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+		// the output blocks are interleaved:
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+	return key[:keyLen], nil
+}
+
+func bcryptHash(out, shapass, shasalt []byte) error {
+	c, err := blowfish.NewSaltedCipher(shapass, shasalt)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+	copy(out, bcryptMagic)
+	for i := 0; i < len(out); i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// blowfish is big-endian, bcrypt_pbkdf output is little-endian:
+	for i := 0; i < len(out); i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+	}
+	return nil
+}
+
+// KeyMatches returns true if the authorized_keys-formatted public key is
+// the same key as 'pub'
+func KeyMatches(authorized []byte, pub ssh.PublicKey) bool {
+	k, _, _, _, err := ssh.ParseAuthorizedKey(authorized)
+	return err == nil && bytes.Equal(k.Marshal(), pub.Marshal())
+}
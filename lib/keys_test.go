@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// the passphrase of the encrypted keys in fixtures/ids
+const fixturePassphrase = "secret"
+
+// withPassphrases makes PassphrasePrompt answer with the given passphrases.
+// Returns how many times it has been asked and a function which restores
+// the prompt and forgets decrypted keys
+func withPassphrases(t *testing.T, answers ...string) (*int, func()) {
+	asked := new(int)
+	prompt := PassphrasePrompt
+	PassphrasePrompt = func(fp string) (string, error) {
+		*asked++
+		if *asked > len(answers) {
+			t.Fatalf("asked for the passphrase of %s too many times", fp)
+		}
+		return answers[*asked-1], nil
+	}
+	return asked, func() {
+		PassphrasePrompt = prompt
+		ForgetDecryptedKeys()
+	}
+}
+
+// fixturePublicKey returns the public key from the .pub file of the fixture
+func fixturePublicKey(t *testing.T, fp string) ssh.PublicKey {
+	pub, err := ReadPublicKey(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestEd25519Identity(t *testing.T) {
+	_, restore := withPassphrases(t)
+	defer restore()
+	i, err := MakeIdentityFromFile("../fixtures/ids/ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := fixturePublicKey(t, "../fixtures/ids/ed25519")
+	if !KeyMatches(i.Logins[0].Key.Pub, pub) {
+		t.Fatalf("wrong public key: %s", i.Logins[0].Key.Pub)
+	}
+	if i.PrivateKeyFor(ssh.MarshalAuthorizedKey(pub)) == nil {
+		t.Fatal("the private key is not found")
+	}
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	for _, fp := range []string{"../fixtures/ids/ed25519-secret", "../fixtures/ids/rsa-secret"} {
+		asked, restore := withPassphrases(t, "wrong", fixturePassphrase)
+		defer restore()
+		priv, signer, err := ReadPrivateKey(fp)
+		if err != nil {
+			t.Fatalf("%s: %v", fp, err)
+		}
+		if *asked != 2 {
+			t.Fatalf("%s: asked for the passphrase %d times instead of 2", fp, *asked)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), fixturePublicKey(t, fp).Marshal()) {
+			t.Fatalf("%s: wrong key", fp)
+		}
+		// Teleport gets the decrypted key:
+		if isEncryptedKey(priv) {
+			t.Fatalf("%s: the key is still encrypted", fp)
+		}
+		if _, err = ssh.ParsePrivateKey(priv); err != nil {
+			t.Fatalf("%s: %v", fp, err)
+		}
+		// the passphrase is asked once:
+		if _, err = MakeIdentityFromFile(fp); err != nil {
+			t.Fatalf("%s: %v", fp, err)
+		}
+		if *asked != 2 {
+			t.Fatalf("%s: asked for the passphrase again", fp)
+		}
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	asked, restore := withPassphrases(t, "one", "two", "three")
+	defer restore()
+	if _, _, err := ReadPrivateKey("../fixtures/ids/ed25519-secret"); err == nil {
+		t.Fatal("the key must not be decrypted with a wrong passphrase")
+	}
+	if *asked != passphraseAttempts {
+		t.Fatalf("asked for the passphrase %d times", *asked)
+	}
+}
+
+func TestBroadcastEncryptedKey(t *testing.T) {
+	_, restore := withPassphrases(t)
+	defer restore()
+	// broadcasters only need public keys: no passphrase is asked
+	i, err := MakeIdentity("../fixtures/ids/ed25519-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := i.Logins[0]
+	if len(l.Key.Priv) != 0 {
+		t.Fatal("the private key must not be loaded")
+	}
+	if !KeyMatches(l.Key.Pub, fixturePublicKey(t, "../fixtures/ids/ed25519-secret")) {
+		t.Fatalf("wrong public key: %s", l.Key.Pub)
+	}
+}
+
+func TestBcryptPBKDF(t *testing.T) {
+	// from OpenBSD's regress/lib/libutil/bcrypt_pbkdf
+	key, err := bcryptPBKDF([]byte("password"), []byte("salt"), 4, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x5b, 0xbf, 0x0c, 0xc2, 0x93, 0x58, 0x7f, 0x1c,
+		0x36, 0x35, 0x55, 0x5c, 0x27, 0x79, 0x65, 0x98,
+		0xd4, 0x7e, 0x57, 0x90, 0x71, 0xbf, 0x42, 0x7e,
+		0x9d, 0x8f, 0xbe, 0x84, 0x2a, 0xba, 0x34, 0xd9,
+	}
+	if !bytes.Equal(key, expected) {
+		t.Fatalf("bcrypt_pbkdf: %x", key)
+	}
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"crypto/rand"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// KnockHeader carries the ID of an approved knock when requesting the
+	// details of a session which requires approval. The server also sets
+	// it on responses which require a knock
+	KnockHeader = "X-Teleconsole-Knock"
+
+	// OwnerTokenHeader authenticates the broadcaster to the server
+	OwnerTokenHeader = "X-Teleconsole-Owner"
+
+	// Knock statuses
+	KnockPending  = "pending"
+	KnockApproved = "approved"
+	KnockDenied   = "denied"
+)
+
+// Knock is a request to join a session which requires the broadcaster's
+// approval
+type Knock struct {
+	// ID is assigned by the server
+	ID string `json:"id"`
+
+	// Name is announced by the joining party, it is not verified
+	Name string `json:"name"`
+
+	// PublicKey (authorized_keys format) and Signature prove that the
+	// joining party holds the private key. Both are optional
+	PublicKey string         `json:"public_key,omitempty"`
+	Signature *ssh.Signature `json:"signature,omitempty"`
+
+	// Fingerprint of the public key, set by the server once it has verified
+	// the signature
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// RemoteAddr of the joining party, as seen by the server
+	RemoteAddr string `json:"remote_addr"`
+
+	// Observer is true if the knock came via the read-only invite
+	Observer bool `json:"observer"`
+
+	// Status is one of KnockPending, KnockApproved or KnockDenied
+	Status string `json:"status"`
+}
+
+// KnockDecision is sent by the broadcaster to approve or deny a knock
+type KnockDecision struct {
+	Approved bool `json:"approved"`
+}
+
+// knockPayload returns the data a knock signature is made over
+func knockPayload(sessionID, name string) []byte {
+	return []byte("teleconsole-knock\x00" + sessionID + "\x00" + name)
+}
+
+// Sign proves the possession of the key to the server of the given session
+func (this *Knock) Sign(sessionID string, signer ssh.Signer) error {
+	sig, err := signer.Sign(rand.Reader, knockPayload(sessionID, this.Name))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	this.PublicKey = string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	this.Signature = sig
+	return nil
+}
+
+// Verify checks the signature of the knock (if it's signed) and sets the
+// fingerprint of its key
+func (this *Knock) Verify(sessionID string) error {
+	this.Fingerprint = ""
+	if this.PublicKey == "" && this.Signature == nil {
+		return nil
+	}
+	if this.Signature == nil {
+		return trace.BadParameter("knock key is not signed")
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(this.PublicKey))
+	if err != nil {
+		return trace.BadParameter("malformed knock key: %v", err)
+	}
+	if err = pub.Verify(knockPayload(sessionID, this.Name), this.Signature); err != nil {
+		return trace.AccessDenied("knock signature does not match its key")
+	}
+	this.Fingerprint = ssh.FingerprintSHA256(pub)
+	return nil
+}
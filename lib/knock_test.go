@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKnockSignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unsigned knocks are fine, they just have no fingerprint:
+	k := &Knock{Name: "alice"}
+	if err = k.Verify("session"); err != nil || k.Fingerprint != "" {
+		t.Fatalf("unsigned knock: %v %q", err, k.Fingerprint)
+	}
+	if err = k.Sign("session", signer); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Verify("session"); err != nil {
+		t.Fatal(err)
+	}
+	if k.Fingerprint != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Fatalf("unexpected fingerprint %q", k.Fingerprint)
+	}
+	// the signature is only good for the same session and name:
+	if err = k.Verify("other-session"); err == nil || k.Fingerprint != "" {
+		t.Fatal("signature for another session must be rejected")
+	}
+	k.Name = "mallory"
+	if err = k.Verify("session"); err == nil {
+		t.Fatal("signature for another name must be rejected")
+	}
+	k.Signature = nil
+	if err = k.Verify("session"); err == nil {
+		t.Fatal("key without signature must be rejected")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/gravitational/trace"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"net"
 	// log "github.com/sirupsen/logrus"
@@ -99,3 +100,79 @@ func ParseForwardAddr(spec string) (p *client.ForwardedPort, err error) {
 	}
 	return p, nil
 }
+
+// PortInvite is an invitation for joining parties to access a host:port
+// via the broadcaster's machine, set via -f flag
+type PortInvite struct {
+	client.ForwardedPort
+	// Label is an optional name of the service behind the port
+	Label string `json:"label,omitempty"`
+}
+
+// ParsePortInvite parses a -f flag spec: an optional label followed by
+// '=' and a host:port spec understood by ParseForwardAddr:
+//
+// "5000"          -> localhost:5000
+// "web=5000"      -> localhost:5000 labeled "web"
+// "db=host:5432"  -> host:5432 labeled "db"
+//
+func ParsePortInvite(spec string) (*PortInvite, error) {
+	var label string
+	if i := strings.Index(spec, "="); i >= 0 && !strings.ContainsAny(spec[:i], ":/") {
+		label, spec = spec[:i], spec[i+1:]
+		if label == "" {
+			return nil, trace.BadParameter("empty label")
+		}
+	}
+	p, err := ParseForwardAddr(spec)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &PortInvite{ForwardedPort: *p, Label: label}, nil
+}
+
+// Matches returns true if the invite is referred to by a given name: its
+// label, destination port or destination host:port
+func (p *PortInvite) Matches(name string) bool {
+	port := strconv.Itoa(p.DestPort)
+	return name == p.Label || name == port || name == net.JoinHostPort(p.DestHost, port)
+}
+
+// PortMapping tells which local address to use for a port invite when
+// joining a session, set via -map flag
+type PortMapping struct {
+	// Invite is the label, port or host:port of the invite
+	Invite  string
+	SrcIP   string
+	SrcPort int
+}
+
+// ParsePortMapping parses a -map flag spec: "invite=[ip:]port", where
+// invite is a label, a port or a host:port of the invite:
+//
+// "web=8080"            -> invite labeled "web" goes to 127.0.0.1:8080
+// "5432=0.0.0.0:15432"  -> invite to port 5432 goes to 0.0.0.0:15432
+//
+func ParsePortMapping(spec string) (*PortMapping, error) {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return nil, trace.BadParameter("expected invite=[ip:]port, got '%s'", spec)
+	}
+	m := &PortMapping{Invite: spec[:i], SrcIP: "127.0.0.1"}
+	addr := spec[i+1:]
+	if strings.Contains(addr, ":") {
+		var (
+			port string
+			err  error
+		)
+		if m.SrcIP, port, err = net.SplitHostPort(addr); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		addr = port
+	}
+	var err error
+	if m.SrcPort, err = strconv.Atoi(addr); err != nil || m.SrcPort <= 0 || m.SrcPort > 65535 {
+		return nil, trace.BadParameter("invalid local port in '%s'", spec)
+	}
+	return m, nil
+}
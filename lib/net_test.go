@@ -44,3 +44,64 @@ func TestNet(t *testing.T) {
 	}
 
 }
+
+func TestPortInvite(t *testing.T) {
+	var testCases = []struct {
+		spec  string
+		label string
+		host  string
+		port  int
+	}{
+		{"5000", "", "localhost", 5000},
+		{"web=5000", "web", "localhost", 5000},
+		{"db=db.internal:5432", "db", "db.internal", 5432},
+		{"api=http://example.com", "api", "example.com", 80},
+		{"http://example.com/?a=b", "", "example.com", 80},
+	}
+	for _, tc := range testCases {
+		p, err := ParsePortInvite(tc.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		if p.Label != tc.label || p.DestHost != tc.host || p.DestPort != tc.port {
+			t.Fatalf("%s: unexpected result %+v", tc.spec, p)
+		}
+	}
+	for _, spec := range []string{"=5000", "web=", "web=foo"} {
+		if _, err := ParsePortInvite(spec); err == nil {
+			t.Fatalf("%s: expected to fail", spec)
+		}
+	}
+}
+
+func TestPortMapping(t *testing.T) {
+	m, err := ParsePortMapping("web=8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Invite != "web" || m.SrcIP != "127.0.0.1" || m.SrcPort != 8080 {
+		t.Fatalf("unexpected mapping: %+v", m)
+	}
+	m, err = ParsePortMapping("db.internal:5432=0.0.0.0:15432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Invite != "db.internal:5432" || m.SrcIP != "0.0.0.0" || m.SrcPort != 15432 {
+		t.Fatalf("unexpected mapping: %+v", m)
+	}
+	for _, spec := range []string{"8080", "=8080", "web=", "web=port", "web=70000"} {
+		if _, err = ParsePortMapping(spec); err == nil {
+			t.Fatalf("%s: expected to fail", spec)
+		}
+	}
+
+	invite, _ := ParsePortInvite("db=db.internal:5432")
+	for _, name := range []string{"db", "5432", "db.internal:5432"} {
+		if !invite.Matches(name) {
+			t.Fatalf("invite must match '%s'", name)
+		}
+	}
+	if invite.Matches("web") {
+		t.Fatalf("invite must not match 'web'")
+	}
+}
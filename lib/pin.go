@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// PINHeader carries the PIN of a PIN-protected session when joining.
+	// The server also sets it on responses which require a PIN
+	PINHeader = "X-Teleconsole-Pin"
+
+	// sealedKeyPrefix marks private keys sealed with a PIN
+	sealedKeyPrefix = "teleconsole-pin:"
+
+	// scrypt parameters: ~100ms per guess on a laptop
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	pinSaltLen   = 16
+	pinKeyLen    = 32
+	pinNonceLen  = 24
+	minPINLength = 10
+)
+
+// CheckPINStrength returns an error if the PIN is too short to be used. The
+// server keeps what the PIN can be checked against, so it has to withstand
+// guessing offline: PINs are more like passphrases
+func CheckPINStrength(pin string) error {
+	if len(pin) < minPINLength {
+		return trace.BadParameter("PIN must be at least %d characters long", minPINLength)
+	}
+	return nil
+}
+
+// derivePINKey stretches a PIN into a 32-byte key
+func derivePINKey(pin string, salt []byte) (*[pinKeyLen]byte, error) {
+	k, err := scrypt.Key([]byte(pin), salt, scryptN, scryptR, scryptP, pinKeyLen)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var key [pinKeyLen]byte
+	copy(key[:], k)
+	return &key, nil
+}
+
+// SealKey encrypts a private key with a PIN, so joining parties could only
+// use it if they know the PIN
+func SealKey(priv []byte, pin string) ([]byte, error) {
+	buf := make([]byte, pinSaltLen+pinNonceLen)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	key, err := derivePINKey(pin, buf[:pinSaltLen])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var nonce [pinNonceLen]byte
+	copy(nonce[:], buf[pinSaltLen:])
+	sealed := secretbox.Seal(buf, priv, &nonce, key)
+	return []byte(sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// IsSealedKey returns true if the private key is sealed with a PIN
+func IsSealedKey(priv []byte) bool {
+	return strings.HasPrefix(string(priv), sealedKeyPrefix)
+}
+
+// OpenKey decrypts a private key sealed by SealKey
+func OpenKey(sealed []byte, pin string) ([]byte, error) {
+	if !IsSealedKey(sealed) {
+		return nil, trace.BadParameter("the key is not sealed")
+	}
+	data, err := base64.StdEncoding.DecodeString(string(sealed[len(sealedKeyPrefix):]))
+	if err != nil || len(data) < pinSaltLen+pinNonceLen+secretbox.Overhead {
+		return nil, trace.BadParameter("malformed sealed key")
+	}
+	key, err := derivePINKey(pin, data[:pinSaltLen])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var nonce [pinNonceLen]byte
+	copy(nonce[:], data[pinSaltLen:])
+	priv, ok := secretbox.Open(nil, data[pinSaltLen+pinNonceLen:], &nonce, key)
+	if !ok {
+		return nil, trace.AccessDenied("wrong PIN")
+	}
+	return priv, nil
+}
+
+// Seal encrypts private keys of all users with a PIN
+func (this UserMap) Seal(pin string) error {
+	for _, u := range this {
+		if u.Key == nil || len(u.Key.Priv) == 0 {
+			continue
+		}
+		sealed, err := SealKey(u.Key.Priv, pin)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		u.Key.Priv = sealed
+	}
+	return nil
+}
+
+// MakePINVerifier returns a salted hash of the PIN for the server to check
+// joining parties against. It does not reveal the key PIN-sealed keys are
+// encrypted with
+func MakePINVerifier(pin string) (string, error) {
+	salt := make([]byte, pinSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", trace.Wrap(err)
+	}
+	key, err := derivePINKey(pin, salt)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// CheckPIN returns true if the PIN matches the verifier
+func CheckPIN(verifier, pin string) bool {
+	parts := strings.SplitN(verifier, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	key, err := derivePINKey(pin, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key[:], expected) == 1
+}
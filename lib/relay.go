@@ -0,0 +1,303 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleport/lib/utils"
+	"github.com/gravitational/trace"
+)
+
+// RemoteForward is a -R spec: the broadcaster's machine listens on
+// BindHost:BindPort and forwards connections to DestHost:DestPort as
+// seen from the joining party's machine
+type RemoteForward struct {
+	BindHost string
+	BindPort int
+	DestHost string
+	DestPort int
+}
+
+// ParseRemoteForwardSpec parses -R flag spec, same as OpenSSH does:
+//
+// "8080:localhost:3000"            -> broadcaster's 127.0.0.1:8080 goes to our localhost:3000
+// "0.0.0.0:8080:localhost:3000"    -> same, but listening on all interfaces
+//
+func ParseRemoteForwardSpec(spec string) (*RemoteForward, error) {
+	parts := strings.Split(spec, ":")
+	f := &RemoteForward{BindHost: "127.0.0.1"}
+	switch len(parts) {
+	case 3:
+	case 4:
+		f.BindHost, parts = parts[0], parts[1:]
+	default:
+		return nil, trace.BadParameter("expected [bind_address:]port:host:hostport, got '%s'", spec)
+	}
+	var err error
+	if f.BindPort, err = strconv.Atoi(parts[0]); err != nil {
+		return nil, trace.BadParameter("invalid port in '%s'", spec)
+	}
+	f.DestHost = parts[1]
+	if f.DestPort, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, trace.BadParameter("invalid port in '%s'", spec)
+	}
+	return f, nil
+}
+
+// BindAddr returns host:port the broadcaster listens on
+func (f *RemoteForward) BindAddr() string {
+	return net.JoinHostPort(f.BindHost, strconv.Itoa(f.BindPort))
+}
+
+// DestAddr returns host:port connections are forwarded to
+func (f *RemoteForward) DestAddr() string {
+	return net.JoinHostPort(f.DestHost, strconv.Itoa(f.DestPort))
+}
+
+// Remote forwarding goes against the direction of the SSH session, so the
+// broadcaster runs a relay which joining parties reach via regular (local)
+// port forwarding. The relay speaks a line-based protocol:
+//
+// 1. A joining party opens a control connection and sends
+//    "BIND <bind_addr> <dest_addr>". The relay asks the broadcaster and
+//    replies with "OK <listen_addr>" or "DENIED <reason>".
+// 2. For every connection accepted on bind_addr the relay sends
+//    "CONNECT <id>" over the control connection.
+// 3. The joining party connects to the relay again, sends "DATA <id>" and
+//    the relay splices this connection with the accepted one.
+//
+// Closing the control connection stops the forwarding.
+const (
+	relayBind    = "BIND"
+	relayOK      = "OK"
+	relayDenied  = "DENIED"
+	relayConnect = "CONNECT"
+	relayData    = "DATA"
+
+	// relayConnectTimeout is how long an accepted connection waits for
+	// the joining party to pick it up
+	relayConnectTimeout = time.Second * 30
+)
+
+// RelayServer is the broadcaster's side of remote port forwarding
+type RelayServer struct {
+	sync.Mutex
+	listener net.Listener
+	confirm  func(*RemoteForward) bool
+	pending  map[string]chan net.Conn
+	closers  []io.Closer
+}
+
+// NewRelayServer starts the relay on a random port of 127.0.0.1. Every
+// forwarding request is passed to 'confirm' first
+func NewRelayServer(confirm func(*RemoteForward) bool) (*RelayServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this := &RelayServer{
+		listener: listener,
+		confirm:  confirm,
+		pending:  make(map[string]chan net.Conn),
+	}
+	go this.serve()
+	return this, nil
+}
+
+// Addr returns host:port of the relay
+func (this *RelayServer) Addr() string {
+	return this.listener.Addr().String()
+}
+
+// Close stops the relay and all forwarding it does
+func (this *RelayServer) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	for _, c := range this.closers {
+		c.Close()
+	}
+	this.closers = nil
+	return this.listener.Close()
+}
+
+func (this *RelayServer) track(c io.Closer) {
+	this.Lock()
+	defer this.Unlock()
+	this.closers = append(this.closers, c)
+}
+
+func (this *RelayServer) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		go this.handle(conn)
+	}
+}
+
+func (this *RelayServer) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(relayConnectTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == relayBind:
+		this.handleBind(conn, reader, fields[1], fields[2])
+	case len(fields) == 2 && fields[0] == relayData:
+		this.Lock()
+		c, ok := this.pending[fields[1]]
+		delete(this.pending, fields[1])
+		this.Unlock()
+		if !ok {
+			conn.Close()
+			return
+		}
+		c <- conn
+	default:
+		conn.Close()
+	}
+}
+
+func (this *RelayServer) handleBind(control net.Conn, reader *bufio.Reader, bindAddr, destAddr string) {
+	defer control.Close()
+	f, err := ParseRemoteForwardSpec(bindAddr + ":" + destAddr)
+	if err != nil {
+		fmt.Fprintf(control, "%s %v\n", relayDenied, err)
+		return
+	}
+	if !this.confirm(f) {
+		fmt.Fprintf(control, "%s the broadcaster has refused\n", relayDenied)
+		return
+	}
+	listener, err := net.Listen("tcp", f.BindAddr())
+	if err != nil {
+		fmt.Fprintf(control, "%s %v\n", relayDenied, err)
+		return
+	}
+	defer listener.Close()
+	this.track(listener)
+	if _, err = fmt.Fprintf(control, "%s %s\n", relayOK, listener.Addr()); err != nil {
+		return
+	}
+	// stop when the control connection goes away:
+	go func() {
+		io.Copy(ioutil.Discard, reader)
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		id, err := utils.CryptoRandomHex(16)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		peer := make(chan net.Conn, 1)
+		this.Lock()
+		this.pending[id] = peer
+		this.Unlock()
+		if _, err = fmt.Fprintf(control, "%s %s\n", relayConnect, id); err != nil {
+			conn.Close()
+			return
+		}
+		go func(id string, conn net.Conn) {
+			select {
+			case data := <-peer:
+				splice(conn, data)
+			case <-time.After(relayConnectTimeout):
+				this.Lock()
+				delete(this.pending, id)
+				this.Unlock()
+				conn.Close()
+			}
+		}(id, conn)
+	}
+}
+
+// RunRemoteForward is the joining party's side of remote port forwarding.
+// It asks the relay (reachable via 'dial') to listen on the broadcaster's
+// machine and forwards incoming connections to f.DestAddr() until the
+// relay goes away. 'ready' is called with the address the broadcaster
+// listens on
+func RunRemoteForward(dial func() (net.Conn, error), f *RemoteForward, ready func(string)) error {
+	control, err := dial()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer control.Close()
+	if _, err = fmt.Fprintf(control, "%s %s %s\n", relayBind, f.BindAddr(), f.DestAddr()); err != nil {
+		return trace.Wrap(err)
+	}
+	reader := bufio.NewReader(control)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(fields) != 2 || fields[0] != relayOK {
+		return trace.AccessDenied("remote forwarding of %s is denied: %s", f.BindAddr(), strings.TrimSpace(line))
+	}
+	ready(fields[1])
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		fields = strings.Fields(line)
+		if len(fields) != 2 || fields[0] != relayConnect {
+			return trace.BadParameter("unexpected message from the relay: %q", line)
+		}
+		go func(id string) {
+			local, err := net.Dial("tcp", f.DestAddr())
+			if err != nil {
+				log.Warningf("remote forwarding to %s: %v", f.DestAddr(), err)
+				return
+			}
+			data, err := dial()
+			if err != nil {
+				local.Close()
+				log.Warning(err)
+				return
+			}
+			if _, err = fmt.Fprintf(data, "%s %s\n", relayData, id); err != nil {
+				local.Close()
+				data.Close()
+				return
+			}
+			splice(local, data)
+		}(fields[1])
+	}
+}
+
+// splice copies data between two connections until either one closes
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
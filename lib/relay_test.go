@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+func TestParseRemoteForwardSpec(t *testing.T) {
+	f, err := ParseRemoteForwardSpec("8080:localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BindAddr() != "127.0.0.1:8080" || f.DestAddr() != "localhost:3000" {
+		t.Errorf("bad spec: %+v", f)
+	}
+	f, err = ParseRemoteForwardSpec("0.0.0.0:8080:10.0.0.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BindAddr() != "0.0.0.0:8080" || f.DestAddr() != "10.0.0.1:22" {
+		t.Errorf("bad spec: %+v", f)
+	}
+	for _, spec := range []string{"8080", "8080:localhost", "x:localhost:3000", "8080:localhost:y", "a:b:c:d:e"} {
+		if _, err = ParseRemoteForwardSpec(spec); err == nil {
+			t.Errorf("'%s' must be rejected", spec)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	// the joining party's service:
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte("echo " + line))
+				conn.Close()
+			}()
+		}
+	}()
+	servicePort := service.Addr().(*net.TCPAddr).Port
+
+	allow := true
+	relay, err := NewRelayServer(func(*RemoteForward) bool { return allow })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	dial := func() (net.Conn, error) { return net.Dial("tcp", relay.Addr()) }
+
+	// the broadcaster refuses:
+	allow = false
+	f := &RemoteForward{BindHost: "127.0.0.1", DestHost: "127.0.0.1", DestPort: servicePort}
+	err = RunRemoteForward(dial, f, func(string) { t.Error("must not be ready") })
+	if !trace.IsAccessDenied(err) {
+		t.Fatalf("expected access denied, got %v", err)
+	}
+
+	// the broadcaster allows:
+	allow = true
+	readyC := make(chan string, 1)
+	go RunRemoteForward(dial, f, func(addr string) { readyC <- addr })
+	var addr string
+	select {
+	case addr = <-readyC:
+	case <-time.After(time.Second * 5):
+		t.Fatal("forwarding has not started")
+	}
+	if _, port, _ := net.SplitHostPort(addr); port == "0" || port == strconv.Itoa(servicePort) {
+		t.Fatalf("unexpected listening address %v", addr)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || line != "echo hello\n" {
+			t.Fatalf("bad reply %q: %v", line, err)
+		}
+	}
+
+	// closing the relay stops forwarding:
+	relay.Close()
+	time.Sleep(time.Millisecond * 100)
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("forwarding must stop with the relay")
+	}
+}
@@ -4,17 +4,34 @@ import (
 	"encoding/json"
 	"net"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gravitational/teleport/integration"
 	"github.com/gravitational/teleport/lib/client"
 )
 
+const (
+	// NameHeader carries the display name of a joining party
+	NameHeader = "X-Teleconsole-Name"
+
+	// maxNameLen limits the length of display names
+	maxNameLen = 64
+)
+
 type Party struct {
-	// FullName is not supported for now...
-	FullName   string    `json"full_name"`
+	// FullName is the display name the party has announced (if any)
+	FullName   string    `json:"full_name,omitempty"`
 	RemoteAddr string    `json:"remote_addr"`
 	LastActive time.Time `json:"last_active"`
+	// Observer is true for parties who joined via read-only invite
+	Observer bool `json:"observer"`
+	// ID identifies a connected party on the server, it's used to kick
+	// them out
+	ID string `json:"id,omitempty"`
+	// JoinedAt is when the party has connected
+	JoinedAt time.Time `json:"joined_at,omitempty"`
 }
 
 // Session travels in JSON format between teleconsole client/server
@@ -39,7 +56,50 @@ type Session struct {
 
 	// Forwarded ports: these are set via -f flag on the client
 	// when it creates a new session
+	ForwardedPorts []*PortInvite `json:"forwarded_ports,omitempty"`
+
+	// ForwardedPort is the first of ForwardedPorts, kept for the clients
+	// which only understand a single invite
 	ForwardedPort *client.ForwardedPort `json:"forwarded_port"`
+
+	// ObserverID is the web session ID of the read-only invite (if any)
+	ObserverID string `json:"observer_id,omitempty"`
+
+	// MirrorAddr is host:port (on the broadcaster's machine) of the mirror
+	// read-only observers connect to instead of joining the shell
+	MirrorAddr string `json:"mirror_addr,omitempty"`
+
+	// Observer is set by the server if this session was requested via the
+	// read-only invite: the joining party will not be able to type
+	Observer bool `json:"observer,omitempty"`
+
+	// RelayAddr is host:port (on the broadcaster's machine) of the relay
+	// joining parties use for remote port forwarding (-R flag)
+	RelayAddr string `json:"relay_addr,omitempty"`
+
+	// SOCKSAddr is host:port (on the broadcaster's machine) of the SOCKS
+	// proxy for joining parties, if the broadcaster has enabled it
+	SOCKSAddr string `json:"socks_addr,omitempty"`
+
+	// PINProtected is true if joining parties must know the PIN: the
+	// private keys of this session are sealed with it
+	PINProtected bool `json:"pin_protected,omitempty"`
+
+	// PINVerifier is sent by the broadcaster to let the server check the
+	// PIN of joining parties. The server never gives it out
+	PINVerifier string `json:"pin_verifier,omitempty"`
+
+	// ApprovalRequired is true if the broadcaster approves every joining
+	// party: they must knock first
+	ApprovalRequired bool `json:"approval_required,omitempty"`
+
+	// TrustedCAs admit joining parties with OpenSSH certificates signed by
+	// them: the server gives them certificates for the session
+	TrustedCAs []TrustedCA `json:"trusted_cas,omitempty"`
+
+	// OwnerToken is returned to the broadcaster only. It authenticates the
+	// broadcaster's requests to the server
+	OwnerToken string `json:"owner_token,omitempty"`
 }
 
 type SessionStats struct {
@@ -61,6 +121,16 @@ type ServerVersion struct {
 	WarningMsg string `json:"warn_msg"`
 }
 
+// GetPortInvites returns port forwarding invites of the session, including
+// a single invite of the sessions created by older clients (made anew on
+// every call)
+func (s *Session) GetPortInvites() []*PortInvite {
+	if len(s.ForwardedPorts) == 0 && s.ForwardedPort != nil {
+		return []*PortInvite{{ForwardedPort: *s.ForwardedPort}}
+	}
+	return s.ForwardedPorts
+}
+
 func (s *Session) GetNodeHostPort() (host string, port int, err error) {
 	h, p, err := net.SplitHostPort(s.NodeHostPort)
 	if err != nil {
@@ -82,3 +152,19 @@ func (s *Session) ToJSON() string {
 	}
 	return string(bytes)
 }
+
+// CleanName makes a display name safe to show in the broadcaster's
+// terminal: control characters are dropped and the length is limited
+func CleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if r := []rune(name); len(r) > maxNameLen {
+		name = string(r[:maxNameLen])
+	}
+	return name
+}
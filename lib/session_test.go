@@ -0,0 +1,30 @@
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	if name := CleanName("  Alice Smith "); name != "Alice Smith" {
+		t.Fatalf("unexpected name %q", name)
+	}
+	// escape sequences must not reach the broadcaster's terminal:
+	if name := CleanName("Eve\x1b]0;pwned\x07"); name != "Eve]0;pwned" {
+		t.Fatalf("unexpected name %q", name)
+	}
+	if name := CleanName(strings.Repeat("ж", 100)); len([]rune(name)) != maxNameLen {
+		t.Fatalf("expected a name of %d characters, got %q", maxNameLen, name)
+	}
+}
+
+func TestPartyJSON(t *testing.T) {
+	data, err := json.Marshal(&Party{FullName: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"full_name":"Alice"`) {
+		t.Fatalf("full name is not serialized: %s", data)
+	}
+}
@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// SOCKSRule is a single entry of the SOCKS allow-list
+type SOCKSRule struct {
+	// Host is a host name (lower case), "*.domain" or "*" for any host.
+	// Empty if the rule is for a network
+	Host string
+	// Net is set for IP address and CIDR rules
+	Net *net.IPNet
+	// Port is the allowed port, 0 means any
+	Port int
+}
+
+// SOCKSAllowList defines destinations joining parties may connect to via
+// the broadcaster's SOCKS proxy (-D flag). It only limits the proxy: the
+// parties can reach other destinations by forwarding ports via SSH (-L)
+type SOCKSAllowList []SOCKSRule
+
+// ParseSOCKSAllowList parses a comma-separated list of destinations:
+//
+// "db.internal:5432"      -> only port 5432 of db.internal
+// "10.0.0.0/8"            -> any port on 10.x.x.x
+// "*.corp.example.com:443,192.168.1.10"
+// "*"                     -> anything (use with care)
+//
+func ParseSOCKSAllowList(spec string) (SOCKSAllowList, error) {
+	var list SOCKSAllowList
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rule, err := parseSOCKSRule(entry)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		list = append(list, *rule)
+	}
+	if len(list) == 0 {
+		return nil, trace.BadParameter("empty SOCKS allow-list")
+	}
+	return list, nil
+}
+
+func parseSOCKSRule(entry string) (*SOCKSRule, error) {
+	rule := &SOCKSRule{}
+	host := entry
+	// split the port off (careful with IPv6 networks like "fd00::/8"):
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host = h
+		if p != "*" {
+			if rule.Port, err = strconv.Atoi(p); err != nil || rule.Port <= 0 || rule.Port > 65535 {
+				return nil, trace.BadParameter("invalid port in '%s'", entry)
+			}
+		}
+	}
+	if host == "" {
+		return nil, trace.BadParameter("missing host in '%s'", entry)
+	}
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		rule.Net = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		rule.Host = strings.ToLower(host)
+	}
+	return rule, nil
+}
+
+// AllowsHost returns true if connecting to port of the named host is allowed
+// by a host rule
+func (this SOCKSAllowList) AllowsHost(host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range this {
+		if r.Host == "" || (r.Port != 0 && r.Port != port) {
+			continue
+		}
+		if r.Host == "*" || r.Host == host ||
+			(strings.HasPrefix(r.Host, "*.") && strings.HasSuffix(host, r.Host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP returns true if connecting to port of the IP address is allowed
+func (this SOCKSAllowList) AllowsIP(ip net.IP, port int) bool {
+	for _, r := range this {
+		if r.Port != 0 && r.Port != port {
+			continue
+		}
+		if r.Host == "*" || (r.Net != nil && r.Net.Contains(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDynamicForwardSpec parses -D flag spec "[bind_address:]port" and
+// returns the local address of the SOCKS proxy
+func ParseDynamicForwardSpec(spec string) (ip string, port int, err error) {
+	ip = "127.0.0.1"
+	p := spec
+	if strings.Contains(spec, ":") {
+		if ip, p, err = net.SplitHostPort(spec); err != nil {
+			return "", 0, trace.BadParameter("expected [bind_address:]port, got '%s'", spec)
+		}
+	}
+	if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+		return "", 0, trace.BadParameter("invalid port in '%s'", spec)
+	}
+	return ip, port, nil
+}
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksIPv4            = 1
+	socksDomain          = 3
+	socksIPv6            = 4
+	socksSucceeded       = 0
+	socksNotAllowed      = 2
+	socksHostUnreachable = 4
+	socksNotSupported    = 7
+
+	// socksHandshakeTimeout limits the time a client has to tell us where
+	// it wants to go
+	socksHandshakeTimeout = time.Second * 30
+)
+
+// SOCKSServer is a SOCKS5 proxy (CONNECT only, no authentication) which
+// lets joining parties reach allowed destinations via the broadcaster's
+// machine. It listens on localhost and is reached via port forwarding,
+// so SSH takes care of authentication
+type SOCKSServer struct {
+	listener net.Listener
+	allow    SOCKSAllowList
+}
+
+// NewSOCKSServer starts a SOCKS5 proxy on a random port of 127.0.0.1
+func NewSOCKSServer(allow SOCKSAllowList) (*SOCKSServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this := &SOCKSServer{listener: listener, allow: allow}
+	go this.serve()
+	return this, nil
+}
+
+// Addr returns host:port of the proxy
+func (this *SOCKSServer) Addr() string {
+	return this.listener.Addr().String()
+}
+
+// Close stops the proxy
+func (this *SOCKSServer) Close() error {
+	return this.listener.Close()
+}
+
+func (this *SOCKSServer) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := this.handle(conn); err != nil {
+				log.Debugf("SOCKS: %v", err)
+			}
+		}()
+	}
+}
+
+func (this *SOCKSServer) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	// greeting: VER NMETHODS METHODS...
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		conn.Close()
+		return trace.Wrap(err)
+	}
+	if buf[0] != socksVersion {
+		conn.Close()
+		return trace.BadParameter("unsupported SOCKS version %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return trace.Wrap(err)
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil || method != socksNoAuth {
+		conn.Close()
+		return trace.BadParameter("no acceptable authentication method")
+	}
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		conn.Close()
+		return trace.Wrap(err)
+	}
+	if buf[1] != socksConnect {
+		socksReply(conn, socksNotSupported)
+		return trace.BadParameter("unsupported SOCKS command %d", buf[1])
+	}
+	var (
+		host string
+		ip   net.IP
+	)
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if buf[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		if _, err := io.ReadFull(conn, buf[:size]); err != nil {
+			conn.Close()
+			return trace.Wrap(err)
+		}
+		ip = net.IP(append([]byte{}, buf[:size]...))
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			conn.Close()
+			return trace.Wrap(err)
+		}
+		name := buf[1 : 1+int(buf[0])]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			conn.Close()
+			return trace.Wrap(err)
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksNotSupported)
+		return trace.BadParameter("unsupported SOCKS address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		conn.Close()
+		return trace.Wrap(err)
+	}
+	port := int(binary.BigEndian.Uint16(buf[:2]))
+
+	dest, err := this.destination(host, ip, port)
+	if err != nil {
+		socksReply(conn, socksNotAllowed)
+		return trace.Wrap(err)
+	}
+	target, err := net.DialTimeout("tcp", dest, socksHandshakeTimeout)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return trace.Wrap(err)
+	}
+	if _, err = conn.Write([]byte{socksVersion, socksSucceeded, 0, socksIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		conn.Close()
+		target.Close()
+		return trace.Wrap(err)
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("SOCKS: connected to %v", dest)
+	splice(conn, target)
+	return nil
+}
+
+// destination checks the requested destination against the allow-list and
+// returns the address to dial. Host names which are not allowed by name
+// are resolved and allowed if one of their addresses is
+func (this *SOCKSServer) destination(host string, ip net.IP, port int) (string, error) {
+	sport := strconv.Itoa(port)
+	if ip != nil {
+		if this.allow.AllowsIP(ip, port) {
+			return net.JoinHostPort(ip.String(), sport), nil
+		}
+		return "", trace.AccessDenied("%v:%v is not allowed", ip, port)
+	}
+	if this.allow.AllowsHost(host, port) {
+		return net.JoinHostPort(host, sport), nil
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return "", trace.AccessDenied("%v:%v is not allowed", host, port)
+	}
+	for _, addr := range addrs {
+		if this.allow.AllowsIP(addr, port) {
+			return net.JoinHostPort(addr.String(), sport), nil
+		}
+	}
+	return "", trace.AccessDenied("%v:%v is not allowed", host, port)
+}
+
+// socksReply sends a reply with an error code and closes the connection
+func socksReply(conn net.Conn, code byte) error {
+	defer conn.Close()
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSOCKSAllowList(t *testing.T) {
+	list, err := ParseSOCKSAllowList("db.internal:5432, 10.0.0.0/8,*.corp.example.com:443,192.168.1.10:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []struct {
+		host  string
+		port  int
+		allow bool
+	}{
+		{"db.internal", 5432, true},
+		{"DB.internal.", 5432, true},
+		{"db.internal", 22, false},
+		{"wiki.corp.example.com", 443, true},
+		{"corp.example.com", 443, false},
+		{"wiki.corp.example.com", 80, false},
+		{"example.com", 80, false},
+	}
+	for _, h := range hosts {
+		if list.AllowsHost(h.host, h.port) != h.allow {
+			t.Errorf("%s:%d: expected allowed=%v", h.host, h.port, h.allow)
+		}
+	}
+	ips := []struct {
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"10.1.2.3", 22, true},
+		{"11.1.2.3", 22, false},
+		{"192.168.1.10", 8080, true},
+		{"192.168.1.11", 8080, false},
+	}
+	for _, i := range ips {
+		if list.AllowsIP(net.ParseIP(i.ip), i.port) != i.allow {
+			t.Errorf("%s:%d: expected allowed=%v", i.ip, i.port, i.allow)
+		}
+	}
+	for _, spec := range []string{"", " , ", "host:0", "host:http", ":80"} {
+		if _, err = ParseSOCKSAllowList(spec); err == nil {
+			t.Errorf("'%s' must be rejected", spec)
+		}
+	}
+	ip, port, err := ParseDynamicForwardSpec("1080")
+	if err != nil || ip != "127.0.0.1" || port != 1080 {
+		t.Errorf("bad -D spec: %v %v %v", ip, port, err)
+	}
+	ip, port, err = ParseDynamicForwardSpec("0.0.0.0:1081")
+	if err != nil || ip != "0.0.0.0" || port != 1081 {
+		t.Errorf("bad -D spec: %v %v %v", ip, port, err)
+	}
+	if _, _, err = ParseDynamicForwardSpec("socks"); err == nil {
+		t.Error("invalid -D spec must be rejected")
+	}
+}
+
+func TestSOCKSServer(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	list, err := ParseSOCKSAllowList("localhost,127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks, err := NewSOCKSServer(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+
+	// connect returns the reply code and the connection
+	connect := func(atyp byte, addr []byte, port int) (byte, net.Conn) {
+		conn, err := net.Dial("tcp", socks.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{socksVersion, 1, socksNoAuth})
+		reply := make([]byte, 10)
+		if _, err = io.ReadFull(conn, reply[:2]); err != nil || reply[1] != socksNoAuth {
+			t.Fatalf("bad greeting reply %v: %v", reply[:2], err)
+		}
+		req := []byte{socksVersion, socksConnect, 0, atyp}
+		if atyp == socksDomain {
+			req = append(req, byte(len(addr)))
+		}
+		req = append(req, addr...)
+		req = append(req, 0, 0)
+		binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+		conn.Write(req)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply[1], conn
+	}
+
+	// allowed by name:
+	code, conn := connect(socksDomain, []byte("localhost"), targetPort)
+	if code != socksSucceeded {
+		t.Fatalf("expected success, got %d", code)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if string(data) != "hi" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	// 127.0.0.1 is only allowed on port 1:
+	code, conn = connect(socksIPv4, net.ParseIP("127.0.0.1").To4(), targetPort)
+	conn.Close()
+	if code != socksNotAllowed {
+		t.Fatalf("expected the connection to be denied, got %d", code)
+	}
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleport/lib/client"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// keysTimeout is how long public key services have to answer
+	keysTimeout = time.Second * 30
+
+	// maxKeysSize limits the size of public key lists we download
+	maxKeysSize = 1 << 20
+
+	// maxKeysPages limits paginated public key lists
+	maxKeysPages = 20
+
+	// gitlabHost is used for "gitlab:user" sources with no host
+	gitlabHost = "gitlab.com"
+)
+
+var (
+	// keysClient fetches public keys of identity sources
+	keysClient = &http.Client{Timeout: keysTimeout}
+
+	// bitbucketAPI is the base URL of Bitbucket API
+	bitbucketAPI = "https://api.bitbucket.org/2.0"
+)
+
+// identitySources resolve prefixed identity sources, like "gitlab:user", to
+// logins with public keys only
+var identitySources = map[string]func(string) ([]sshLogin, error){
+	"github":    loginsFromGithub,
+	"gitlab":    loginsFromGitlab,
+	"bitbucket": loginsFromBitbucket,
+	"url":       loginsFromURL,
+	"file":      loginsFromAuthorizedKeys,
+}
+
+// prefixedSource splits "prefix:value" identity sources. Returns nil if the
+// source has no known prefix
+func prefixedSource(idSrc string) (func(string) ([]sshLogin, error), string) {
+	parts := strings.SplitN(idSrc, ":", 2)
+	if len(parts) != 2 {
+		return nil, ""
+	}
+	return identitySources[parts[0]], parts[1]
+}
+
+// loginsFromGitlab returns logins for the keys of "user" or "user@host" on
+// GitLab (gitlab.com or a self-hosted one)
+func loginsFromGitlab(spec string) ([]sshLogin, error) {
+	username, host := spec, gitlabHost
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		username, host = spec[:i], spec[i+1:]
+	}
+	if username == "" || host == "" {
+		return nil, trace.BadParameter("invalid GitLab identity '%s', expected user or user@host", spec)
+	}
+	keys, err := fetchAuthorizedKeys(fmt.Sprintf("https://%s/%s.keys", host, url.PathEscape(username)))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return loginsFromKeys(username, keys), nil
+}
+
+// loginsFromBitbucket returns logins for the keys of the Bitbucket user
+func loginsFromBitbucket(username string) ([]sshLogin, error) {
+	var keys []ssh.PublicKey
+	next := fmt.Sprintf("%s/users/%s/ssh-keys", bitbucketAPI, url.PathEscape(username))
+	for page := 0; next != "" && page < maxKeysPages; page++ {
+		data, err := fetchKeys(next)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		var resp struct {
+			Values []struct {
+				Key string `json:"key"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err = json.Unmarshal(data, &resp); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		for _, v := range resp.Values {
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v.Key)); err == nil {
+				keys = append(keys, pub)
+			}
+		}
+		next = resp.Next
+	}
+	if len(keys) == 0 {
+		return nil, trace.NotFound("Bitbucket user '%s' has no SSH keys", username)
+	}
+	return loginsFromKeys(username, keys), nil
+}
+
+// loginsFromURL returns logins for the keys (in authorized_keys format) at
+// the URL. Keys must come over HTTPS, otherwise anyone on the way could
+// swap them and join
+func loginsFromURL(rawurl string) ([]sshLogin, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if u.Scheme != "https" {
+		return nil, trace.BadParameter("public keys must be fetched over https, not '%s'", rawurl)
+	}
+	keys, err := fetchAuthorizedKeys(rawurl)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return loginsFromKeys(u.Hostname(), keys), nil
+}
+
+// loginsFromAuthorizedKeys returns logins for the keys in a local file in
+// authorized_keys format
+func loginsFromAuthorizedKeys(fp string) ([]sshLogin, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	keys, err := parseAuthorizedKeys(data, fp)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return loginsFromKeys(filepath.Base(fp), keys), nil
+}
+
+// loginsFromKeys makes a login labeled "<label><N>" for every key
+func loginsFromKeys(label string, keys []ssh.PublicKey) (logins []sshLogin) {
+	for i, pub := range keys {
+		logins = append(logins, sshLogin{
+			Username: fmt.Sprintf("%s%d", label, i),
+			Key: &client.Key{
+				Pub: ssh.MarshalAuthorizedKey(pub),
+			},
+		})
+	}
+	return logins
+}
+
+// fetchAuthorizedKeys downloads public keys in authorized_keys format
+func fetchAuthorizedKeys(keysURL string) ([]ssh.PublicKey, error) {
+	data, err := fetchKeys(keysURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return parseAuthorizedKeys(data, keysURL)
+}
+
+// fetchKeys downloads a list of public keys
+func fetchKeys(keysURL string) ([]byte, error) {
+	resp, err := keysClient.Get(keysURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKeysSize))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.Errorf("failed to get public keys from %s: %s", keysURL, resp.Status)
+	}
+	return data, nil
+}
+
+// parseAuthorizedKeys returns the public keys in authorized_keys format,
+// skipping comments and key options. 'from' is where they come from
+func parseAuthorizedKeys(data []byte, from string) (keys []ssh.PublicKey, err error) {
+	for {
+		var pub ssh.PublicKey
+		if pub, _, _, data, err = ssh.ParseAuthorizedKey(data); err != nil {
+			break
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, trace.NotFound("no public keys found in %s", from)
+	}
+	return keys, nil
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyServer stands in for GitHub, GitLab, Bitbucket and a plain web server
+// with public keys. Returns a function which stops it and restores the
+// public key APIs
+func keyServer(t *testing.T) (*httptest.Server, func()) {
+	one, err := ioutil.ReadFile("../fixtures/ids/one.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := ioutil.ReadFile("../fixtures/ids/two.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alice.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# alice's keys\n%s\n%s", one, two)
+	})
+	mux.HandleFunc("/2.0/users/bob/ssh-keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"values":[{"key":%q}],"next":"%s/2.0/users/bob/ssh-keys?page=2"}`,
+				strings.TrimSpace(string(one)), "https://"+r.Host)
+			return
+		}
+		fmt.Fprintf(w, `{"values":[{"key":%q}]}`, strings.TrimSpace(string(two)))
+	})
+	mux.HandleFunc("/users/carol/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id":1,"key":%q}]`, strings.TrimSpace(string(one)))
+	})
+	mux.HandleFunc("/users/alice/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id":1,"key":%q}]`, strings.TrimSpace(string(two)))
+	})
+	mux.HandleFunc("/nobody/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# no keys here\n")
+	})
+	mux.HandleFunc("/team/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `command="echo hi" %s`, two)
+	})
+	server := httptest.NewTLSServer(mux)
+
+	client, github, bitbucket := keysClient, githubAPI, bitbucketAPI
+	keysClient = server.Client()
+	githubAPI = server.URL
+	bitbucketAPI = server.URL + "/2.0"
+	return server, func() {
+		keysClient, githubAPI, bitbucketAPI = client, github, bitbucket
+		server.Close()
+	}
+}
+
+func TestIdentitySources(t *testing.T) {
+	server, stop := keyServer(t)
+	defer stop()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "teleconsole-keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authorized := filepath.Join(dir, "authorized_keys")
+	one, _ := ioutil.ReadFile("../fixtures/ids/one.pub")
+	if err = ioutil.WriteFile(authorized, one, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		source string
+		logins []string
+	}{
+		{source: "gitlab:alice@" + host, logins: []string{"alice0", "alice1"}},
+		{source: "bitbucket:bob", logins: []string{"bob0", "bob1"}},
+		{source: "github:carol", logins: []string{"carol0"}},
+		// url: keys are labeled by the host:
+		{source: "url:" + server.URL + "/team/keys", logins: []string{"127.0.0.10"}},
+		{source: "file:" + authorized, logins: []string{"authorized_keys0"}},
+	}
+	for _, tc := range testCases {
+		i, err := MakeIdentity(tc.source)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.source, err)
+		}
+		if len(i.Logins) != len(tc.logins) {
+			t.Fatalf("%s: expected %d logins, got %d", tc.source, len(tc.logins), len(i.Logins))
+		}
+		for n, l := range i.Logins {
+			if l.Username != tc.logins[n] {
+				t.Fatalf("%s: expected login %s, got %s", tc.source, tc.logins[n], l.Username)
+			}
+			if len(l.Key.Pub) == 0 || len(l.Key.Priv) != 0 {
+				t.Fatalf("%s: logins must have public keys only", tc.source)
+			}
+		}
+	}
+}
+
+// TestSameUserOnTwoSources makes sure the keys of one source don't replace
+// the keys of another one with the same logins
+func TestSameUserOnTwoSources(t *testing.T) {
+	server, stop := keyServer(t)
+	defer stop()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	i, err := MakeIdentity("alice,gitlab:alice@" + host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alice0", "alice0-1", "alice1"}
+	if len(i.Logins) != len(expected) {
+		t.Fatalf("expected %d logins, got %d", len(expected), len(i.Logins))
+	}
+	for n, l := range i.Logins {
+		if l.Username != expected[n] {
+			t.Fatalf("expected login %s, got %s", expected[n], l.Username)
+		}
+	}
+	if users := i.LoginUsers(); len(users) != len(expected) {
+		t.Fatalf("expected %d users, got %v", len(expected), users)
+	}
+}
+
+func TestBadIdentitySources(t *testing.T) {
+	server, stop := keyServer(t)
+	defer stop()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	for _, source := range []string{
+		// no such user:
+		"gitlab:nobody@" + host,
+		// no keys:
+		"url:" + server.URL + "/nobody/keys",
+		// keys must come over https:
+		"url:http://" + host + "/team/keys",
+		"gitlab:@" + host,
+		"file:../fixtures/ids/nothing",
+	} {
+		if _, err := MakeIdentity(source); err == nil {
+			t.Fatalf("%s: must fail", source)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stdinReader reads lines from stdin when it's not a terminal. There's only
+// one, so the input it has buffered is never lost between reads
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// stdinFd is the file descriptor of stdin
+func stdinFd() int {
+	return int(os.Stdin.Fd())
+}
+
+// IsTerminal returns true if stdin is a terminal
+func IsTerminal() bool {
+	return terminal.IsTerminal(stdinFd())
+}
+
+// MakeRaw puts the terminal into raw mode: no echo, no line editing and no
+// signals on Ctrl+C. Returns a function which restores the previous mode
+func MakeRaw() (restore func(), err error) {
+	state, err := terminal.MakeRaw(stdinFd())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return func() { terminal.Restore(stdinFd(), state) }, nil
+}
+
+// ReadPassword prints a prompt and reads a line from the terminal
+// without echoing it
+func ReadPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if IsTerminal() {
+		line, err := terminal.ReadPassword(stdinFd())
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		return string(line), nil
+	}
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", trace.Wrap(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// TerminalSize returns the size of the terminal attached to stdin
+func TerminalSize() (width, height int, err error) {
+	width, height, err = terminal.GetSize(stdinFd())
+	if err != nil {
+		return 0, 0, trace.Wrap(err)
+	}
+	return width, height, nil
+}
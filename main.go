@@ -3,10 +3,13 @@ package main
 import (
 	//"crypto/x509"
 
+	"context"
 	"crypto/x509"
 	"fmt"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gravitational/teleconsole/clt"
@@ -18,6 +21,8 @@ func main() {
 
 	app, err := clt.NewApp(nil)
 	fatalIf(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	conf := app.GetConfig()
 
@@ -34,7 +39,12 @@ func main() {
 		case "help":
 			app.Usage()
 		case "join":
-			err = app.Join()
+			go handleSignals(catchSignals(), cancel)
+			err = app.Join(ctx)
+		case "play":
+			err = app.Play()
+		case "server":
+			err = app.Server()
 		case "version":
 			version.Print("Teleconsole", conf.Verbosity > 0)
 			os.Exit(0)
@@ -43,12 +53,39 @@ func main() {
 		}
 		// no CLI args? Start a new broadcast!
 	} else {
-		err = app.Start()
+		go handleSignals(catchSignals(), cancel)
+		err = app.Start(ctx)
 	}
 	fatalIf(err)
 }
 
+// catchSignals starts catching the signals which end sessions. It's called
+// before the session starts, so none of them kills teleconsole in between
+func catchSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	return signals
+}
+
+// handleSignals ends the session when teleconsole is killed or its terminal
+// is closed, so the local SSH server and its keys are cleaned up. Another
+// signal while the session is ending kills teleconsole right away.
+//
+// Only the sessions (broadcast and join) are ended this way, the other
+// commands keep the default behavior of signals
+func handleSignals(signals chan os.Signal, cancel context.CancelFunc) {
+	sig := <-signals
+	logrus.Infof("received %v, ending the session", sig)
+	cancel()
+	<-signals
+	os.Exit(1)
+}
+
 func fatalIf(err error) {
+	// the command launched via -c has failed, pass its status along:
+	if exitErr, ok := trace.Unwrap(err).(*clt.ExitError); ok {
+		os.Exit(exitErr.Code)
+	}
 	if err != nil {
 		// see if it's untrusted HTTPS certificate error?
 		if badCert, url := IsUntrustedCertError(err); badCert {
@@ -0,0 +1,279 @@
+// Package sdk lets Go programs broadcast and join Teleconsole sessions
+// without the command line tool:
+//
+//	s, err := sdk.Broadcast(ctx, sdk.Options{Stdin: in, Stdout: out})
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//	fmt.Println("join with: teleconsole join", s.ID)
+//	for e := range s.Events {
+//		...
+//	}
+//
+// The messages teleconsole prints for humans only go to Options.Messages.
+// Diagnostics are logged with the standard logrus logger, and passphrases of
+// encrypted keys are asked for on the terminal by lib.PassphrasePrompt:
+// programs which must not write to stderr or read the terminal should
+// configure the logger and replace the prompt. Decrypted keys are remembered
+// until lib.ForgetDecryptedKeys is called.
+package sdk
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleconsole/clt"
+	"github.com/gravitational/teleconsole/conf"
+	"github.com/gravitational/teleconsole/geo"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleconsole/version"
+)
+
+// eventsBuffer is how many events are kept for a slow reader of
+// Session.Events, the rest are dropped
+const eventsBuffer = 100
+
+// configureOnce makes sure Teleport is configured once per process
+var configureOnce sync.Once
+
+// Options define a session to broadcast or join
+type Options struct {
+	// Server is host[:port] of the Teleconsole server. If not set, the
+	// fastest public server is used
+	Server string
+
+	// Insecure makes the client trust invalid TLS certificates
+	Insecure bool
+
+	// Identity is the SSH key (or Github user, or public key source like
+	// "gitlab:user", or "ca:user_ca.pub" for certified keys) joining parties
+	// need when broadcasting, or the private key to join with
+	Identity string
+
+	// Command is shared instead of a shell when broadcasting. The
+	// session ends when the command exits
+	Command string
+
+	// Ports are port invites for joining parties, like "web=3000"
+	Ports []string
+
+	// Observers enables the read-only invite
+	Observers bool
+
+	// PIN protects the broadcast or unlocks the session to join
+	PIN string
+
+	// Name is announced to the broadcaster when joining
+	Name string
+
+	// GithubAPI and GithubToken are used to find the keys of Github users
+	// and members of organizations or teams ("@org/team") for Identity
+	GithubAPI   string
+	GithubToken string
+
+	// Stdin and Stdout of the shared shell. Nothing is typed in and the
+	// output is discarded if they are not set
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	// Messages receives the messages teleconsole prints for humans. They
+	// are discarded if it is not set
+	Messages io.Writer
+}
+
+// Session is a running broadcast or a joined session
+type Session struct {
+	// ID is the Teleconsole ID of the session
+	ID string
+
+	// ObserverID is the read-only Teleconsole ID (if Options.Observers
+	// is set)
+	ObserverID string
+
+	// WebURL is the web UI of the session (not available for sessions
+	// restricted to a key)
+	WebURL string
+
+	// Events delivers the session events: parties joining and leaving,
+	// and the end of the session. It is closed when the session ends
+	Events <-chan lib.Event
+
+	events chan lib.Event
+	cancel context.CancelFunc
+	stdin  *io.PipeWriter
+	done   chan struct{}
+	err    error
+}
+
+// Broadcast starts a new session. It returns once the session is ready to
+// be joined
+func Broadcast(ctx context.Context, opts Options) (*Session, error) {
+	c, err := makeConfig(opts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if opts.Server == "" {
+		if err = c.SetEndpointHost(geo.FindFastestEndpoint(ctx).Hostname); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	for _, spec := range opts.Ports {
+		invite, err := lib.ParsePortInvite(spec)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		c.PortInvites = append(c.PortInvites, invite)
+	}
+	c.IdentityFile = opts.Identity
+	c.GithubAPI = opts.GithubAPI
+	c.GithubToken = opts.GithubToken
+	c.RunCommand = opts.Command
+	c.Observers = opts.Observers
+	c.PIN = opts.PIN
+	c.Notify = clt.NotifyNone
+
+	api := clt.NewAPIClient(c, version.Version)
+	s := start(ctx, c, func(ctx context.Context) error {
+		return clt.StartBroadcast(ctx, c, api)
+	})
+	return s.waitFor(lib.EventSessionCreated)
+}
+
+// Join joins the session with the given Teleconsole ID. It returns once
+// the session is joined
+func Join(ctx context.Context, id string, opts Options) (*Session, error) {
+	c, err := makeConfig(opts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if opts.Server == "" {
+		var host string
+		if host, id = geo.EndpointForSession(id); host != "" {
+			if err = c.SetEndpointHost(host); err != nil {
+				return nil, trace.Wrap(err)
+			}
+		}
+	}
+	if len(opts.Ports) > 0 || opts.Command != "" || opts.Observers {
+		return nil, trace.BadParameter("ports, command and observers are only for broadcasts")
+	}
+	c.IdentityFile = opts.Identity
+	c.PIN = opts.PIN
+	c.Name = lib.CleanName(opts.Name)
+
+	api := clt.NewAPIClient(c, version.Version)
+	s := start(ctx, c, func(ctx context.Context) error {
+		if err := api.CheckVersion(ctx); err != nil {
+			return trace.Wrap(err)
+		}
+		return clt.Join(ctx, c, api, id)
+	})
+	return s.waitFor(lib.EventSessionJoined)
+}
+
+// makeConfig returns the client configuration for the options
+func makeConfig(opts Options) (*conf.Config, error) {
+	configureOnce.Do(clt.ConfigureTeleport)
+	c := &conf.Config{
+		InsecureHTTPS: opts.Insecure,
+		Stdin:         opts.Stdin,
+		Stdout:        opts.Stdout,
+		MessageOut:    opts.Messages,
+	}
+	server := opts.Server
+	if server == "" {
+		server = net.JoinHostPort(conf.DefaultServerHost, conf.DefaultServerPort)
+	}
+	if err := c.SetEndpointHost(server); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if c.Stdout == nil {
+		c.Stdout = ioutil.Discard
+	}
+	if c.MessageOut == nil {
+		c.MessageOut = ioutil.Discard
+	}
+	return c, nil
+}
+
+// start runs the session in the background
+func start(ctx context.Context, c *conf.Config, run func(context.Context) error) *Session {
+	s := &Session{
+		events: make(chan lib.Event, eventsBuffer),
+		done:   make(chan struct{}),
+	}
+	s.Events = s.events
+	ctx, s.cancel = context.WithCancel(ctx)
+	// the session must not read the terminal of the program:
+	if c.Stdin == nil {
+		var in io.Reader
+		in, s.stdin = io.Pipe()
+		c.Stdin = in
+	}
+	c.OnEvent = func(e lib.Event) {
+		select {
+		case s.events <- e:
+		default:
+			log.Warningf("dropped %v event: nobody reads session events", e.Type)
+		}
+	}
+	go func() {
+		s.err = run(ctx)
+		if s.stdin != nil {
+			s.stdin.Close()
+		}
+		close(s.done)
+		close(s.events)
+	}()
+	return s
+}
+
+// waitFor waits until the session emits the event of the given type and
+// fills in the session details from it
+func (this *Session) waitFor(eventType string) (*Session, error) {
+	for e := range this.events {
+		if e.Type == eventType {
+			this.ID = e.SessionID
+			this.ObserverID = e.ObserverID
+			this.WebURL = e.WebURL
+			return this, nil
+		}
+	}
+	// the session has ended before it started:
+	<-this.done
+	if this.err == nil {
+		return nil, trace.ConnectionProblem(nil, "the session has ended prematurely")
+	}
+	return nil, trace.Wrap(this.err)
+}
+
+// Wait waits for the session to end. For broadcasts of a command its exit
+// status is returned as *clt.ExitError
+func (this *Session) Wait() error {
+	<-this.done
+	return this.err
+}
+
+// Close ends the session (a broadcast ends for everybody) and waits until
+// it's over. Returns the error the session has ended with if it has ended
+// on its own
+func (this *Session) Close() error {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+	}
+	this.cancel()
+	if this.stdin != nil {
+		this.stdin.Close()
+	}
+	this.Wait()
+	return nil
+}
@@ -0,0 +1,76 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleconsole/clt/clttest"
+	"github.com/gravitational/teleconsole/lib"
+)
+
+func TestJoinOptions(t *testing.T) {
+	_, err := Join(context.Background(), "abc", Options{Server: "localhost:1", Command: "ls"})
+	if err == nil {
+		t.Fatal("commands can't be given to joining parties")
+	}
+}
+
+// TestBroadcastAndJoin broadcasts a session through a fake Teleconsole
+// server and joins it, following the broadcaster's events
+func TestBroadcastAndJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	srv, err := clttest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	opts := Options{Server: srv.Listener.Addr().String(), Insecure: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	b, err := Broadcast(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.ID == "" || b.WebURL == "" {
+		t.Fatalf("unexpected session: %+v", b)
+	}
+
+	opts.Name = "Alice"
+	j, err := Join(ctx, b.ID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-b.Events:
+		if e.Type != lib.EventPartyJoined || e.Party == nil || e.Party.FullName != "Alice" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("the broadcaster has not seen the joining party")
+	}
+
+	// the broadcaster ends the session for everybody:
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- j.Wait() }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("the joining party is still in the session")
+	}
+	// the last event is the end of the session:
+	var last lib.Event
+	for e := range b.Events {
+		last = e
+	}
+	if last.Type != lib.EventSessionEnded {
+		t.Fatalf("unexpected last event %+v", last)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleport/lib/utils"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// CertNonce issues a nonce for a certificate request. It can be used once,
+// within certNonceTTL
+func (this *proxySession) CertNonce(now time.Time) (string, error) {
+	this.Lock()
+	defer this.Unlock()
+	if this.certNonces == nil {
+		this.certNonces = make(map[string]time.Time)
+	}
+	for nonce, issued := range this.certNonces {
+		if now.Sub(issued) > certNonceTTL {
+			delete(this.certNonces, nonce)
+		}
+	}
+	if len(this.certNonces) >= maxCertNonces {
+		return "", trace.LimitExceeded("too many certificate requests, try again later")
+	}
+	nonce, err := utils.CryptoRandomHex(20)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	this.certNonces[nonce] = now
+	return nonce, nil
+}
+
+// useCertNonce checks the nonce of a certificate request and makes sure it
+// can't be used again
+func (this *proxySession) useCertNonce(nonce string, now time.Time) error {
+	this.Lock()
+	defer this.Unlock()
+	issued, ok := this.certNonces[nonce]
+	if !ok || now.Sub(issued) > certNonceTTL {
+		return trace.AccessDenied("the certificate request has expired, try again")
+	}
+	delete(this.certNonces, nonce)
+	return nil
+}
+
+// Certify checks the joining party's OpenSSH certificate against the CAs
+// the broadcaster trusts and returns a certificate for the same key signed
+// by the proxy. It lets them log in as the session user of the CA (or its
+// observer user, if they join via the read-only ID). The request must carry
+// a nonce issued by CertNonce
+func (this *proxySession) Certify(id string, req *lib.CertRequest, now time.Time) (*lib.CertReply, error) {
+	cert, err := req.Verify(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err = this.useCertNonce(req.Nonce, now); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this.Lock()
+	cas := this.session.TrustedCAs
+	secrets := this.session.Secrets
+	observer := id == this.session.ObserverID
+	this.Unlock()
+
+	if len(cas) == 0 {
+		return nil, trace.AccessDenied("this session does not accept certificates")
+	}
+	var ca *lib.TrustedCA
+	err = trace.AccessDenied("the certificate is not signed by a trusted CA")
+	for i := range cas {
+		if err = cas[i].Check(cert, now); err == nil {
+			ca = &cas[i]
+			break
+		}
+	}
+	if ca == nil {
+		return nil, trace.Wrap(err)
+	}
+	login := ca.Login
+	if observer {
+		login = lib.ObserverName(login)
+	}
+	if this.IsBannedUser(login) {
+		return nil, trace.AccessDenied("you have been kicked out of this session")
+	}
+	user, ok := secrets.Users[login]
+	if !ok || user.Key == nil || len(user.Key.Cert) == 0 {
+		return nil, trace.NotFound("session user %v is not found", login)
+	}
+	// the proxy has certified the session user's throw-away key, the party
+	// gets the same certificate for their own key:
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(user.Key.Cert)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	template, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, trace.BadParameter("session user %v has no certificate", login)
+	}
+	signer, err := ssh.ParsePrivateKey(secrets.PrivKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	issued := *template
+	issued.Key = cert.Key
+	issued.Nonce = nil
+	issued.Signature = nil
+	// it must not outlive the party's own certificate:
+	if cert.ValidBefore < issued.ValidBefore {
+		issued.ValidBefore = cert.ValidBefore
+	}
+	if err = issued.SignCert(rand.Reader, signer); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &lib.CertReply{
+		Username:      login,
+		AllowedLogins: user.AllowedLogins,
+		Cert:          string(ssh.MarshalAuthorizedKey(&issued)),
+	}, nil
+}
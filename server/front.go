@@ -0,0 +1,259 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleport/lib/utils"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// announcementTTL is how long an announcement waits for the party's
+	// connection
+	announcementTTL = time.Minute
+
+	// maxAnnouncements limits how many announcements from the same IP can
+	// wait for their connections
+	maxAnnouncements = 10
+)
+
+// front accepts joining parties' SSH connections in front of a disposable
+// proxy. Teleport only sees connections from the front, so this is where
+// the server knows who is connected and can kick them out
+type front struct {
+	sync.Mutex
+	listener net.Listener
+	// target is host:port of the proxy's SSH listener
+	target string
+	conns  map[string]*frontConn
+	// banned IPs can't connect anymore
+	banned map[string]bool
+	// announcements of joining parties waiting for their connections, by IP
+	announcements map[string][]announcement
+}
+
+// announcement is what a joining party tells about themselves before they
+// connect
+type announcement struct {
+	name string
+	// knock is the ID of the party's knock (if the session requires
+	// approval)
+	knock string
+	at    time.Time
+}
+
+// frontConn is a joining party's connection
+type frontConn struct {
+	net.Conn
+	id       string
+	ip       string
+	joinedAt time.Time
+	// proxyAddr is the address the proxy sees this connection from
+	proxyAddr string
+	// announcement is what the party has told about themselves
+	announcement
+}
+
+// newFront starts accepting connections on a random port of 'host' and
+// forwarding them to 'target'
+func newFront(host, target string) (*front, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this := &front{
+		listener:      listener,
+		target:        target,
+		conns:         make(map[string]*frontConn),
+		banned:        make(map[string]bool),
+		announcements: make(map[string][]announcement),
+	}
+	go this.serve()
+	return this, nil
+}
+
+// Port returns the port joining parties connect to
+func (this *front) Port() string {
+	_, port, _ := net.SplitHostPort(this.listener.Addr().String())
+	return port
+}
+
+// Close stops accepting connections and drops the existing ones
+func (this *front) Close() {
+	this.listener.Close()
+	this.Lock()
+	defer this.Unlock()
+	for _, c := range this.conns {
+		c.Close()
+	}
+}
+
+func (this *front) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		go this.handle(conn)
+	}
+}
+
+func (this *front) handle(conn net.Conn) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if this.IsBanned(ip) {
+		log.Infof("rejected connection from banned %v", ip)
+		conn.Close()
+		return
+	}
+	id, err := utils.CryptoRandomHex(8)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	proxy, err := net.Dial("tcp", this.target)
+	if err != nil {
+		log.Error(err)
+		conn.Close()
+		return
+	}
+	fc := &frontConn{
+		Conn:      conn,
+		id:        id,
+		ip:        ip,
+		joinedAt:  time.Now(),
+		proxyAddr: proxy.LocalAddr().String(),
+	}
+	this.Lock()
+	fc.announcement = this.claim(ip, fc.joinedAt)
+	this.conns[id] = fc
+	this.Unlock()
+	defer func() {
+		this.Lock()
+		delete(this.conns, id)
+		this.Unlock()
+	}()
+
+	done := make(chan struct{}, 2)
+	cp := func(dst io.WriteCloser, src io.Reader) {
+		io.Copy(dst, src)
+		dst.Close()
+		done <- struct{}{}
+	}
+	go cp(proxy, conn)
+	go cp(conn, proxy)
+	<-done
+}
+
+// Parties returns the connected joining parties
+func (this *front) Parties() []lib.Party {
+	this.Lock()
+	defer this.Unlock()
+	parties := []lib.Party{}
+	for _, c := range this.conns {
+		parties = append(parties, lib.Party{
+			ID:         c.id,
+			RemoteAddr: c.RemoteAddr().String(),
+			JoinedAt:   c.joinedAt,
+			FullName:   c.name,
+		})
+	}
+	return parties
+}
+
+// Announce remembers the display name (and the knock) of the party about
+// to connect from 'ip'. It's given to the next connection from 'ip', so
+// parties behind the same address keep their own names. Parties without
+// names announce themselves too, or they'd take the names of the next ones
+func (this *front) Announce(ip, name, knock string) {
+	this.Lock()
+	defer this.Unlock()
+	waiting := this.fresh(ip, time.Now())
+	// the same party may fetch the session more than once:
+	for i, a := range waiting {
+		if a.name == name {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) >= maxAnnouncements {
+		waiting = waiting[1:]
+	}
+	this.announcements[ip] = append(waiting, announcement{name: name, knock: knock, at: time.Now()})
+}
+
+// claim returns the oldest announcement waiting for a connection from 'ip'
+func (this *front) claim(ip string, now time.Time) announcement {
+	waiting := this.fresh(ip, now)
+	if len(waiting) == 0 {
+		return announcement{}
+	}
+	this.announcements[ip] = waiting[1:]
+	return waiting[0]
+}
+
+// fresh returns the announcements from 'ip' which have not expired
+func (this *front) fresh(ip string, now time.Time) []announcement {
+	waiting := this.announcements[ip]
+	for len(waiting) > 0 && now.Sub(waiting[0].at) > announcementTTL {
+		waiting = waiting[1:]
+	}
+	if len(waiting) == 0 {
+		delete(this.announcements, ip)
+	}
+	return waiting
+}
+
+// NameOf returns the display name of the party the proxy sees connecting
+// from 'proxyAddr'
+func (this *front) NameOf(proxyAddr string) string {
+	this.Lock()
+	defer this.Unlock()
+	for _, c := range this.conns {
+		if c.proxyAddr == proxyAddr {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// Kick disconnects the party and bans its IP address from connecting
+// again. Returns the kicked out connection
+func (this *front) Kick(id string) (*frontConn, error) {
+	this.Lock()
+	defer this.Unlock()
+	c, ok := this.conns[id]
+	if !ok {
+		return nil, trace.NotFound("party %v is not found", id)
+	}
+	this.banned[c.ip] = true
+	// the same party may have several connections:
+	for _, other := range this.conns {
+		if other.ip == c.ip {
+			other.Close()
+		}
+	}
+	return c, nil
+}
+
+// Drop disconnects the party the proxy sees connecting from 'proxyAddr'
+func (this *front) Drop(proxyAddr string) {
+	this.Lock()
+	defer this.Unlock()
+	for _, c := range this.conns {
+		if c.proxyAddr == proxyAddr {
+			c.Close()
+		}
+	}
+}
+
+// IsBanned returns true if the IP address has been kicked out
+func (this *front) IsBanned(ip string) bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.banned[ip]
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFront(t *testing.T) {
+	// the "proxy" greets every connection:
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxied := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			proxied <- conn.RemoteAddr().String()
+			conn.Write([]byte("SSH-2.0-proxy\n"))
+		}
+	}()
+	f, err := newFront("127.0.0.1", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// parties announce their names before connecting, every connection
+	// gets its own (even from the same address):
+	f.Announce("127.0.0.1", "Alice", "")
+	f.Announce("127.0.0.1", "Alice", "alice-knock")
+	f.Announce("127.0.0.1", "Bob", "bob-knock")
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", f.Port()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		if line, err := reader.ReadString('\n'); err != nil || line != "SSH-2.0-proxy\n" {
+			t.Fatalf("connection is not forwarded: %q %v", line, err)
+		}
+		return conn, reader
+	}
+	conn, reader := dial()
+	defer conn.Close()
+	parties := f.Parties()
+	if len(parties) != 1 || parties[0].ID == "" || parties[0].JoinedAt.IsZero() {
+		t.Fatalf("unexpected parties: %+v", parties)
+	}
+	if parties[0].RemoteAddr != conn.LocalAddr().String() {
+		t.Fatalf("expected the real address of the party, got %v", parties[0].RemoteAddr)
+	}
+	if parties[0].FullName != "Alice" {
+		t.Fatalf("expected the announced name, got %q", parties[0].FullName)
+	}
+	if name := f.NameOf(<-proxied); name != "Alice" {
+		t.Fatalf("expected the announced name, got %q", name)
+	}
+	bob, bobReader := dial()
+	defer bob.Close()
+	bobProxied := <-proxied
+	if name := f.NameOf(bobProxied); name != "Bob" {
+		t.Fatalf("expected the name of the second party, got %q", name)
+	}
+	// a new announcement does not rename the connected parties:
+	f.Announce("127.0.0.1", "Mallory", "")
+	for _, p := range f.Parties() {
+		if p.FullName == "Mallory" {
+			t.Fatal("connected parties must keep their names")
+		}
+	}
+	parties = f.Parties()
+	for _, p := range parties {
+		if p.FullName == "Alice" {
+			parties[0] = p
+		}
+	}
+
+	// kick:
+	if _, err = f.Kick("nope"); err == nil {
+		t.Fatal("unknown party must not be kicked")
+	}
+	// parties can be dropped by the address the proxy sees:
+	f.Drop(bobProxied)
+	bob.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = bobReader.ReadString('\n'); err == nil {
+		t.Fatal("dropped party must be disconnected")
+	}
+	kicked, err := f.Kick(parties[0].ID)
+	if err != nil || kicked.ip != "127.0.0.1" || kicked.knock != "alice-knock" {
+		t.Fatalf("kick failed: %+v %v", kicked, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = reader.ReadString('\n'); err == nil {
+		t.Fatal("kicked out party must be disconnected")
+	}
+	if !f.IsBanned("127.0.0.1") {
+		t.Fatal("kicked out party must be banned")
+	}
+	// banned parties can't get through anymore:
+	conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", f.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Fatal("banned party must not get through")
+	}
+}
@@ -0,0 +1,581 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleconsole/version"
+	"github.com/gravitational/trace"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DefaultListenAddr is where the API server listens unless told otherwise
+	DefaultListenAddr = "0.0.0.0:443"
+
+	// DefaultProxyHost is the interface disposable proxies listen on
+	DefaultProxyHost = "0.0.0.0"
+
+	// DefaultSessionTTL is the maximum lifetime of a session
+	DefaultSessionTTL = time.Hour * 24
+
+	// DefaultOrphanTTL defines how long a session may stay without a
+	// connected broadcaster before its proxy is torn down
+	DefaultOrphanTTL = time.Minute * 2
+
+	// maxSessionBytes limits the size of the new session request
+	maxSessionBytes = 1 << 20
+)
+
+// Config defines the configuration of the Teleconsole API server
+type Config struct {
+	// ListenAddr is host:port the HTTPS API is served on
+	ListenAddr string
+
+	// ProxyHost is the host (interface) disposable SSH proxies bind to
+	ProxyHost string
+
+	// CertFile and KeyFile point to the TLS certificate. If they are not
+	// set, a self-signed certificate is generated on startup
+	CertFile string
+	KeyFile  string
+
+	// WarningMsg (if set) is shown to every connecting client
+	WarningMsg string
+
+	// SessionTTL is the maximum lifetime of a session
+	SessionTTL time.Duration
+
+	// OrphanTTL defines how long a session can live without the
+	// broadcaster's reverse tunnel
+	OrphanTTL time.Duration
+}
+
+// CheckAndSetDefaults validates the config and fills in the missing values
+func (this *Config) CheckAndSetDefaults() error {
+	if this.ListenAddr == "" {
+		this.ListenAddr = DefaultListenAddr
+	}
+	if this.ProxyHost == "" {
+		this.ProxyHost = DefaultProxyHost
+	}
+	if this.SessionTTL == 0 {
+		this.SessionTTL = DefaultSessionTTL
+	}
+	if this.OrphanTTL == 0 {
+		this.OrphanTTL = DefaultOrphanTTL
+	}
+	if (this.CertFile == "") != (this.KeyFile == "") {
+		return trace.BadParameter("both TLS certificate and key files must be given")
+	}
+	return nil
+}
+
+// Server is the Teleconsole API server. For every new session it launches
+// a disposable, single-tenant Teleport proxy which trusts the broadcaster's
+// local Teleport instance.
+type Server struct {
+	sync.Mutex
+	config   Config
+	router   *httprouter.Router
+	sessions map[string]*proxySession
+	closeC   chan struct{}
+}
+
+// New creates a new server. Call ListenAndServe() to start it
+func New(config Config) (*Server, error) {
+	if err := config.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this := &Server{
+		config:   config,
+		router:   httprouter.New(),
+		sessions: make(map[string]*proxySession),
+		closeC:   make(chan struct{}),
+	}
+	this.router.GET("/ping", this.ping)
+	this.router.GET("/api/version", this.getVersion)
+	this.router.POST("/api/sessions", this.createSession)
+	this.router.GET("/api/sessions/:id", this.getSession)
+	this.router.DELETE("/api/sessions/:id", this.endSession)
+	this.router.GET("/api/sessions/:id/stats", this.getSessionStats)
+	this.router.GET("/api/sessions/:id/certs", this.getCertChallenge)
+	this.router.POST("/api/sessions/:id/certs", this.requestCert)
+	this.router.POST("/api/sessions/:id/knocks", this.addKnock)
+	this.router.GET("/api/sessions/:id/knocks", this.getPendingKnocks)
+	this.router.GET("/api/sessions/:id/knocks/:kid", this.getKnock)
+	this.router.PUT("/api/sessions/:id/knocks/:kid", this.decideKnock)
+	this.router.GET("/api/sessions/:id/parties", this.getParties)
+	this.router.DELETE("/api/sessions/:id/parties/:pid", this.kickParty)
+	this.router.POST("/api/session/:id", this.publishSession)
+	this.router.GET("/s/:id", this.webSession)
+	return this, nil
+}
+
+// ServeHTTP makes Server an http.Handler
+func (this *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.router.ServeHTTP(w, r)
+}
+
+// ListenAndServe starts serving the API over HTTPS and blocks
+func (this *Server) ListenAndServe() error {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if this.config.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(this.config.CertFile, this.config.KeyFile)
+	} else {
+		log.Warning("no TLS certificate given, using a self-signed one")
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	listener, err := net.Listen("tcp", this.config.ListenAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	go this.reapSessions()
+	defer this.Close()
+
+	log.Infof("Teleconsole server %v is listening on %v", version.Version, listener.Addr())
+	srv := &http.Server{
+		Handler:   this,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	return trace.Wrap(srv.Serve(tls.NewListener(listener, srv.TLSConfig)))
+}
+
+// Close stops all disposable proxies
+func (this *Server) Close() {
+	this.Lock()
+	defer this.Unlock()
+	select {
+	case <-this.closeC:
+		return
+	default:
+		close(this.closeC)
+	}
+	for id, s := range this.sessions {
+		if id == s.session.ID {
+			s.Stop()
+		}
+		delete(this.sessions, id)
+	}
+}
+
+// reapSessions periodically stops proxies of the sessions which have
+// expired or lost their broadcaster
+func (this *Server) reapSessions() {
+	ticker := time.NewTicker(this.config.OrphanTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.closeC:
+			return
+		case now := <-ticker.C:
+			this.Lock()
+			for id, s := range this.sessions {
+				if id != s.session.ID {
+					continue
+				}
+				if s.IsExpired(now, this.config.SessionTTL, this.config.OrphanTTL) {
+					log.Infof("session %v has expired", id)
+					s.Stop()
+					for _, id := range s.IDs() {
+						delete(this.sessions, id)
+					}
+				}
+			}
+			this.Unlock()
+		}
+	}
+}
+
+func (this *Server) findSession(id string) (*proxySession, error) {
+	this.Lock()
+	defer this.Unlock()
+	s, ok := this.sessions[id]
+	if !ok {
+		return nil, trace.NotFound("session %v is not found", id)
+	}
+	return s, nil
+}
+
+// GET /ping
+func (this *Server) ping(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	fmt.Fprint(w, "pong")
+}
+
+// GET /api/version
+func (this *Server) getVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("client version %v connected from %v",
+		r.Header.Get(lib.ClientVersionHeader), r.RemoteAddr)
+	replyJSON(w, &lib.ServerVersion{
+		ServerVersion: version.Version,
+		WarningMsg:    this.config.WarningMsg,
+	})
+}
+
+// POST /api/sessions
+//
+// Receives broadcaster's secrets, launches a disposable proxy which trusts
+// them and returns the proxy's secrets back to the broadcaster
+func (this *Server) createSession(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req lib.Session
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionBytes)).Decode(&req); err != nil {
+		trace.WriteError(w, trace.BadParameter("malformed session: %v", err))
+		return
+	}
+	if req.ID == "" || req.Secrets.SiteName == "" || req.NodeHostPort == "" {
+		trace.WriteError(w, trace.BadParameter("session ID, secrets and node address are required"))
+		return
+	}
+	if req.ObserverID == req.ID {
+		trace.WriteError(w, trace.BadParameter("observer ID must differ from session ID"))
+		return
+	}
+	this.Lock()
+	_, exists := this.sessions[req.ID]
+	if req.ObserverID != "" && !exists {
+		_, exists = this.sessions[req.ObserverID]
+	}
+	this.Unlock()
+	if exists {
+		trace.WriteError(w, trace.AlreadyExists("session %v already exists", req.ID))
+		return
+	}
+	s, err := startProxySession(this.config.ProxyHost, &req)
+	if err != nil {
+		log.Error(err)
+		trace.WriteError(w, err)
+		return
+	}
+	this.Lock()
+	for _, id := range s.IDs() {
+		this.sessions[id] = s
+	}
+	this.Unlock()
+	log.Infof("created session %v for %v", req.ID, req.Login)
+	// only the broadcaster learns the owner token and the proxy's secrets:
+	replyJSON(w, s.OwnerSession())
+}
+
+// POST /api/session/:id
+//
+// The broadcaster publishes the ID of the Teleport session joining parties
+// will connect to. The body is a plain text Teleport session ID. Only the
+// broadcaster can do it: otherwise anyone could lead the parties elsewhere
+func (this *Server) publishSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	s, err := this.findOwnSession(r, id)
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSessionBytes))
+	if err != nil {
+		trace.WriteError(w, trace.BadParameter("failed reading session ID: %v", err))
+		return
+	}
+	tsid := strings.TrimSpace(string(body))
+	if tsid == "" {
+		trace.WriteError(w, trace.BadParameter("empty Teleport session ID"))
+		return
+	}
+	s.Publish(id, tsid)
+	replyJSON(w, map[string]string{"tsid": tsid})
+}
+
+// GET /api/sessions/:id
+//
+// PIN-protected sessions are only given to the clients who send the PIN
+// via lib.PINHeader
+func (this *Server) getSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	s := this.admitParty(w, r, id)
+	if s == nil {
+		return
+	}
+	s.Announce(clientIP(r), r.Header.Get(lib.NameHeader), r.Header.Get(lib.KnockHeader))
+	replyJSON(w, s.Session(id))
+}
+
+// GET /api/sessions/:id/certs
+//
+// Issues the nonce for a certificate request
+func (this *Server) getCertChallenge(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s := this.admitParty(w, r, p.ByName("id"))
+	if s == nil {
+		return
+	}
+	nonce, err := s.CertNonce(time.Now())
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, &lib.CertChallenge{Nonce: nonce})
+}
+
+// POST /api/sessions/:id/certs
+//
+// A joining party with an OpenSSH certificate signed by one of the CAs the
+// broadcaster trusts gets a certificate to log into the session with. The
+// request is signed over the nonce from GET /api/sessions/:id/certs
+func (this *Server) requestCert(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	s := this.admitParty(w, r, id)
+	if s == nil {
+		return
+	}
+	var req lib.CertRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionBytes)).Decode(&req); err != nil {
+		trace.WriteError(w, trace.BadParameter("malformed certificate request: %v", err))
+		return
+	}
+	reply, err := s.Certify(id, &req, time.Now())
+	if err != nil {
+		log.Warningf("session %v: %v (from %v)", id, err, r.RemoteAddr)
+		trace.WriteError(w, err)
+		return
+	}
+	log.Infof("session %v: certified %v from %v", id, reply.Username, r.RemoteAddr)
+	replyJSON(w, reply)
+}
+
+// admitParty finds the session a joining party wants via 'id' and checks
+// they are allowed in: not kicked out, with the right PIN and approved (if
+// the session needs it). Writes the error and returns nil otherwise
+func (this *Server) admitParty(w http.ResponseWriter, r *http.Request, id string) *proxySession {
+	s := this.checkParty(w, r, id)
+	if s == nil {
+		return nil
+	}
+	if err := s.CheckKnock(id, r.Header.Get(lib.KnockHeader)); err != nil {
+		w.Header().Set(lib.KnockHeader, "required")
+		trace.WriteError(w, err)
+		return nil
+	}
+	return s
+}
+
+// checkParty finds the session a joining party wants via 'id' and checks
+// they are not kicked out and have the right PIN, which is all they need to
+// knock. Writes the error and returns nil otherwise
+func (this *Server) checkParty(w http.ResponseWriter, r *http.Request, id string) *proxySession {
+	s, err := this.findSession(id)
+	if err != nil {
+		trace.WriteError(w, err)
+		return nil
+	}
+	if s.IsBanned(clientIP(r)) {
+		trace.WriteError(w, trace.AccessDenied("you have been kicked out of this session"))
+		return nil
+	}
+	if err = s.CheckPIN(clientIP(r), r.Header.Get(lib.PINHeader)); err != nil {
+		log.Warningf("session %v: %v (from %v)", id, err, r.RemoteAddr)
+		w.Header().Set(lib.PINHeader, "required")
+		trace.WriteError(w, err)
+		return nil
+	}
+	return s
+}
+
+// DELETE /api/sessions/:id
+//
+// The broadcaster has ended the session, its proxy is no longer needed
+func (this *Server) endSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findOwnSession(r, p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	this.Lock()
+	for _, id := range s.IDs() {
+		delete(this.sessions, id)
+	}
+	this.Unlock()
+	log.Infof("session %v has ended", p.ByName("id"))
+	s.Stop()
+	replyJSON(w, map[string]string{"status": "ok"})
+}
+
+// GET /api/sessions/:id/stats
+func (this *Server) getSessionStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findSession(p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	stats, err := s.Stats()
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, stats)
+}
+
+// POST /api/sessions/:id/knocks
+//
+// A joining party asks the broadcaster's permission to join
+func (this *Server) addKnock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	// strangers must not bother the broadcaster with questions:
+	s := this.checkParty(w, r, id)
+	if s == nil {
+		return
+	}
+	var k lib.Knock
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionBytes)).Decode(&k); err != nil {
+		trace.WriteError(w, trace.BadParameter("malformed knock: %v", err))
+		return
+	}
+	if err := k.Verify(id); err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	k.RemoteAddr = clientIP(r)
+	k.Name = lib.CleanName(k.Name)
+	knock, err := s.AddKnock(id, k)
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	log.Infof("session %v: %v is knocking from %v", id, knock.Name, knock.RemoteAddr)
+	replyJSON(w, knock)
+}
+
+// GET /api/sessions/:id/knocks/:kid
+//
+// A joining party waits for the broadcaster's decision
+func (this *Server) getKnock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findSession(p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	knock, err := s.GetKnock(p.ByName("kid"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, knock)
+}
+
+// GET /api/sessions/:id/knocks
+//
+// The broadcaster polls for the parties waiting for approval
+func (this *Server) getPendingKnocks(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findOwnSession(r, p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, s.PendingKnocks())
+}
+
+// PUT /api/sessions/:id/knocks/:kid
+//
+// The broadcaster approves or denies a knock
+func (this *Server) decideKnock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findOwnSession(r, p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	var d lib.KnockDecision
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionBytes)).Decode(&d); err != nil {
+		trace.WriteError(w, trace.BadParameter("malformed decision: %v", err))
+		return
+	}
+	if err = s.DecideKnock(p.ByName("kid"), d.Approved); err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	knock, err := s.GetKnock(p.ByName("kid"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, knock)
+}
+
+// GET /api/sessions/:id/parties
+//
+// The broadcaster lists the joining parties connected to the proxy
+func (this *Server) getParties(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findOwnSession(r, p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, s.Parties())
+}
+
+// DELETE /api/sessions/:id/parties/:pid
+//
+// The broadcaster kicks a party out of the session. The party's IP address
+// can't join the session again
+func (this *Server) kickParty(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, err := this.findOwnSession(r, p.ByName("id"))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	if err = s.Kick(p.ByName("pid")); err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	replyJSON(w, s.Parties())
+}
+
+// findOwnSession finds the session for requests only the broadcaster can
+// make: they must carry the owner token
+func (this *Server) findOwnSession(r *http.Request, id string) (*proxySession, error) {
+	s, err := this.findSession(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if !s.IsOwner(r.Header.Get(lib.OwnerTokenHeader)) {
+		return nil, trace.AccessDenied("only the broadcaster can do this")
+	}
+	return s, nil
+}
+
+// GET /s/:id
+//
+// Web UI is not available on self-hosted servers, this explains how to join
+func (this *Server) webSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := this.findSession(p.ByName("id")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, "This server does not offer a web UI. To join this session type:\n\n"+
+		"> teleconsole -s %s join %s\n", r.Host, p.ByName("id"))
+}
+
+// clientIP returns the IP address of the client who made the request
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func replyJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,689 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleconsole/version"
+	"github.com/gravitational/teleport/integration"
+	"github.com/gravitational/teleport/lib/client"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerAPI(t *testing.T) {
+	srv, err := New(Config{WarningMsg: "be nice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// ping:
+	resp, err := http.Get(ts.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "pong" {
+		t.Fatalf("bad ping response: %v %q", resp.Status, body)
+	}
+
+	// version:
+	resp, err = http.Get(ts.URL + "/api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sv lib.ServerVersion
+	if err = json.NewDecoder(resp.Body).Decode(&sv); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if sv.ServerVersion != version.Version || sv.WarningMsg != "be nice" {
+		t.Fatalf("bad version response: %+v", sv)
+	}
+
+	// unknown sessions:
+	for _, url := range []string{"/api/sessions/nope", "/api/sessions/nope/stats"} {
+		resp, err = http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %v", url, resp.Status)
+		}
+	}
+	resp, err = http.Post(ts.URL+"/api/session/nope", "text/plain", strings.NewReader("tsid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 when publishing unknown session, got %v", resp.Status)
+	}
+
+	// malformed session requests:
+	for _, body := range []string{"not json", `{"id":"x"}`} {
+		resp, err = http.Post(ts.URL+"/api/sessions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%q: expected 400, got %v", body, resp.Status)
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{}
+	if err := c.CheckAndSetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != DefaultListenAddr || c.ProxyHost != DefaultProxyHost {
+		t.Fatalf("defaults are not set: %+v", c)
+	}
+	c = Config{CertFile: "cert.pem"}
+	if err := c.CheckAndSetDefaults(); err == nil {
+		t.Fatal("certificate without a key must be rejected")
+	}
+}
+
+func TestObserverSession(t *testing.T) {
+	s := &proxySession{session: lib.Session{ID: "main", ObserverID: "watch"}, ownerToken: "owner"}
+	s.session.Secrets.PrivKey = []byte("proxy CA key")
+	s.session.Secrets.Users = map[string]*integration.User{
+		"alice":          {Username: "alice", AllowedLogins: []string{"alice"}},
+		"observer-alice": {Username: "observer-alice", AllowedLogins: []string{lib.ObserverLogin}},
+	}
+	s.session.MirrorAddr = "127.0.0.1:4000"
+	if ids := s.IDs(); len(ids) != 2 {
+		t.Fatalf("expected two IDs, got %v", ids)
+	}
+	s.Publish("main", "tsid-main")
+	s.Publish("watch", "tsid-watch")
+
+	main := s.Session("main")
+	if main.TSID != "tsid-main" || main.Observer || main.ObserverID != "watch" {
+		t.Fatalf("bad main session: %+v", main)
+	}
+	watch := s.Session("watch")
+	if watch.TSID != "tsid-watch" || !watch.Observer || watch.ID != "watch" {
+		t.Fatalf("bad observer session: %+v", watch)
+	}
+	if watch.ObserverID != "" {
+		t.Fatalf("observers must not see the observer ID field")
+	}
+	// observers only get their own users, which can only log into the
+	// mirror, and joining parties don't get them at all:
+	if _, ok := watch.Secrets.Users["observer-alice"]; !ok || len(watch.Secrets.Users) != 1 {
+		t.Fatalf("observers must get the observer users only: %v", watch.Secrets.Users)
+	}
+	if _, ok := main.Secrets.Users["alice"]; !ok || len(main.Secrets.Users) != 1 {
+		t.Fatalf("joining parties must not get the observer users: %v", main.Secrets.Users)
+	}
+	if watch.MirrorAddr == "" || main.MirrorAddr != "" {
+		t.Fatalf("only observers need the mirror: %v, %v", watch.MirrorAddr, main.MirrorAddr)
+	}
+	// only the broadcaster gets the proxy's CA key:
+	if len(main.Secrets.PrivKey) != 0 || len(watch.Secrets.PrivKey) != 0 {
+		t.Fatal("joining parties must not get the proxy's CA private key")
+	}
+	owned := s.OwnerSession()
+	if string(owned.Secrets.PrivKey) != "proxy CA key" || owned.OwnerToken != "owner" {
+		t.Fatalf("bad broadcaster's session: %+v", owned)
+	}
+	if len(s.session.Secrets.PrivKey) == 0 {
+		t.Fatal("copies must not change the session")
+	}
+}
+
+func TestPINProtectedSession(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	verifier, err := lib.MakePINVerifier("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.sessions["pinned"] = &proxySession{
+		session:     lib.Session{ID: "pinned", PINProtected: true},
+		pinVerifier: verifier,
+	}
+	// there's no proxy to stop:
+	defer delete(srv.sessions, "pinned")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	get := func(pin string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/sessions/pinned", nil)
+		if pin != "" {
+			req.Header.Set(lib.PINHeader, pin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(""); resp.StatusCode != http.StatusForbidden || resp.Header.Get(lib.PINHeader) == "" {
+		t.Fatalf("expected the PIN to be required, got %v", resp.Status)
+	}
+	if resp := get("correct horse"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the right PIN to work, got %v", resp.Status)
+	}
+	for i := 0; i < maxPINFailures; i++ {
+		if resp := get("0000"); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected the wrong PIN to be rejected, got %v", resp.Status)
+		}
+	}
+	if resp := get("correct horse"); resp.StatusCode == http.StatusOK {
+		t.Fatal("the client must be locked out after too many wrong PINs")
+	}
+	// but nobody else is:
+	s := srv.sessions["pinned"]
+	if err = s.CheckPIN("10.0.0.1", "correct horse"); err != nil {
+		t.Fatalf("other clients must not be locked out: %v", err)
+	}
+}
+
+func TestKnocks(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := &proxySession{
+		session:    lib.Session{ID: "main", ObserverID: "watch", ApprovalRequired: true},
+		ownerToken: "owner",
+		knocks:     make(map[string]*knock),
+	}
+	srv.sessions["main"], srv.sessions["watch"] = s, s
+	// there's no proxy to stop:
+	defer delete(srv.sessions, "main")
+	defer delete(srv.sessions, "watch")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	call := func(method, url string, headers map[string]string, in, out interface{}) int {
+		var body bytes.Buffer
+		if in != nil {
+			json.NewEncoder(&body).Encode(in)
+		}
+		req, _ := http.NewRequest(method, ts.URL+url, &body)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+	owner := map[string]string{lib.OwnerTokenHeader: "owner"}
+
+	// the session can't be joined without knocking:
+	if code := call("GET", "/api/sessions/main", nil, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	var k, observer lib.Knock
+	call("POST", "/api/sessions/main/knocks", nil, &lib.Knock{Name: "alice"}, &k)
+	call("POST", "/api/sessions/watch/knocks", nil, &lib.Knock{Name: "bob"}, &observer)
+	if k.ID == "" || k.Status != lib.KnockPending || k.RemoteAddr != "127.0.0.1" || k.Observer {
+		t.Fatalf("bad knock: %+v", k)
+	}
+	if !observer.Observer {
+		t.Fatalf("knock via the observer ID must be marked: %+v", observer)
+	}
+	if code := call("GET", "/api/sessions/main", map[string]string{lib.KnockHeader: k.ID}, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("pending knock must not let in, got %v", code)
+	}
+
+	// only the broadcaster can see and decide:
+	if code := call("GET", "/api/sessions/main/knocks", nil, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	var pending []lib.Knock
+	call("GET", "/api/sessions/main/knocks", owner, nil, &pending)
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending knocks, got %v", pending)
+	}
+	if code := call("PUT", "/api/sessions/main/knocks/"+k.ID, nil, &lib.KnockDecision{Approved: true}, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	call("PUT", "/api/sessions/main/knocks/"+k.ID, owner, &lib.KnockDecision{Approved: true}, nil)
+	call("PUT", "/api/sessions/main/knocks/"+observer.ID, owner, &lib.KnockDecision{Approved: false}, nil)
+
+	call("GET", "/api/sessions/main/knocks/"+k.ID, nil, nil, &k)
+	if k.Status != lib.KnockApproved {
+		t.Fatalf("expected approved knock, got %+v", k)
+	}
+	var session lib.Session
+	if code := call("GET", "/api/sessions/main", map[string]string{lib.KnockHeader: k.ID}, nil, &session); code != http.StatusOK {
+		t.Fatalf("approved knock must let in, got %v", code)
+	}
+	if session.OwnerToken != "" {
+		t.Fatal("joining parties must not learn the owner token")
+	}
+	// approval via the main ID does not let into the observer session and
+	// denied knocks do not let in at all:
+	if code := call("GET", "/api/sessions/watch", map[string]string{lib.KnockHeader: k.ID}, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	if code := call("GET", "/api/sessions/watch", map[string]string{lib.KnockHeader: observer.ID}, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+
+	// only the broadcaster can publish the Teleport session:
+	publish := func(headers map[string]string) int {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/session/main", strings.NewReader("tsid-evil"))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := publish(map[string]string{lib.KnockHeader: k.ID}); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	if s.Session("main").TSID == "tsid-evil" {
+		t.Fatal("joining parties must not publish sessions")
+	}
+	if code := publish(owner); code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", code)
+	}
+
+	// only the broadcaster can end the session:
+	if code := call("DELETE", "/api/sessions/main", nil, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	if code := call("DELETE", "/api/sessions/nope", owner, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v", code)
+	}
+}
+
+// TestKnockLimits makes sure strangers can't flood the broadcaster with
+// questions
+func TestKnockLimits(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	verifier, err := lib.MakePINVerifier("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.sessions["main"] = &proxySession{
+		session:     lib.Session{ID: "main", PINProtected: true, ApprovalRequired: true},
+		pinVerifier: verifier,
+		knocks:      make(map[string]*knock),
+	}
+	// there's no proxy to stop:
+	defer delete(srv.sessions, "main")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	knock := func(pin string) int {
+		body, _ := json.Marshal(&lib.Knock{Name: "mallory"})
+		req, _ := http.NewRequest("POST", ts.URL+"/api/sessions/main/knocks", bytes.NewReader(body))
+		req.Header.Set(lib.PINHeader, pin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// knocking takes the PIN:
+	if code := knock("0000"); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+	if pending := srv.sessions["main"].PendingKnocks(); len(pending) != 0 {
+		t.Fatalf("knocks without the PIN must not reach the broadcaster: %v", pending)
+	}
+	for i := 0; i < maxClientKnocks; i++ {
+		if code := knock("correct horse"); code != http.StatusOK {
+			t.Fatalf("expected 200, got %v", code)
+		}
+	}
+	if code := knock("correct horse"); code == http.StatusOK {
+		t.Fatal("the client must not knock more than maxClientKnocks times")
+	}
+}
+
+func TestKick(t *testing.T) {
+	// the "proxy" takes whatever the front forwards:
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go ioutil.ReadAll(conn)
+		}
+	}()
+	f, err := newFront("127.0.0.1", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := &proxySession{
+		session: lib.Session{ID: "main", ApprovalRequired: true},
+		knocks:  make(map[string]*knock),
+		front:   f,
+	}
+	s.session.Secrets.Users = map[string]*integration.User{
+		"alice":  {Username: "alice", Key: &client.Key{Pub: []byte("alice's key")}},
+		"anyone": {Username: "anyone", Key: &client.Key{Pub: []byte("key"), Priv: []byte("key")}},
+	}
+
+	// alice knocks, gets approved and connects:
+	k, err := s.AddKnock("main", lib.Knock{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DecideKnock(k.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	s.Announce("127.0.0.1", "alice", k.ID)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", f.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var parties []lib.Party
+	for i := 0; i < 50 && len(parties) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		parties = s.Parties()
+	}
+	if len(parties) != 1 {
+		t.Fatalf("expected 1 party, got %v", parties)
+	}
+
+	// kicking her out revokes her approval, not just her address:
+	if err = s.Kick(parties[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CheckKnock("main", k.ID); err == nil {
+		t.Fatal("the knock of a kicked out party must be revoked")
+	}
+	if !s.IsBanned("127.0.0.1") {
+		t.Fatal("the address of a kicked out party must be banned")
+	}
+
+	// her user is given to nobody anymore, unless everyone logs in as it:
+	s.Lock()
+	if !s.banUser("alice") || s.banUser("anyone") {
+		t.Fatal("only the users of their own can be banned")
+	}
+	s.Unlock()
+	users := s.Session("main").Secrets.Users
+	if _, ok := users["alice"]; ok {
+		t.Fatal("the user of a kicked out party must not be given away")
+	}
+	if _, ok := users["anyone"]; !ok {
+		t.Fatal("shared users must stay")
+	}
+	if !s.IsBannedUser("alice") {
+		t.Fatal("the user of a kicked out party must be banned")
+	}
+}
+
+// newTestKey generates an ECDSA key, returns its signer and PEM
+func newTestKey(t *testing.T) (ssh.Signer, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// signTestCert certifies the key with the CA for the principals
+func signTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, validBefore time.Time, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertRequests(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	proxyCA, proxyPriv := newTestKey(t)
+	userCA, _ := newTestKey(t)
+	otherCA, _ := newTestKey(t)
+	placeholder, _ := newTestKey(t)
+	key, _ := newTestKey(t)
+
+	// the proxy has certified the session user of the CA:
+	expires := time.Now().Add(time.Hour)
+	template := signTestCert(t, proxyCA, placeholder.PublicKey(), expires, "guest")
+	s := &proxySession{
+		session: lib.Session{
+			ID: "main",
+			Secrets: integration.InstanceSecrets{
+				PrivKey: proxyPriv,
+				Users: map[string]*integration.User{
+					"user_ca": {
+						AllowedLogins: []string{"guest"},
+						Key: &client.Key{
+							Pub:  ssh.MarshalAuthorizedKey(placeholder.PublicKey()),
+							Cert: ssh.MarshalAuthorizedKey(template),
+						},
+					},
+				},
+			},
+			TrustedCAs: []lib.TrustedCA{{
+				Key:        string(ssh.MarshalAuthorizedKey(userCA.PublicKey())),
+				Principals: []string{"ops"},
+				Login:      "user_ca",
+			}},
+		},
+	}
+	srv.sessions["main"] = s
+	// there's no proxy to stop:
+	defer delete(srv.sessions, "main")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// nonce gets a nonce for a certificate request
+	nonce := func() string {
+		resp, err := http.Get(ts.URL + "/api/sessions/main/certs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var challenge lib.CertChallenge
+		if err = json.NewDecoder(resp.Body).Decode(&challenge); err != nil || challenge.Nonce == "" {
+			t.Fatalf("no nonce: %v", err)
+		}
+		return challenge.Nonce
+	}
+	post := func(req *lib.CertRequest, reply *lib.CertReply) int {
+		data, _ := json.Marshal(req)
+		resp, err := http.Post(ts.URL+"/api/sessions/main/certs", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if reply != nil && resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(reply)
+		}
+		return resp.StatusCode
+	}
+	request := func(cert *ssh.Certificate, signer ssh.Signer, reply *lib.CertReply) int {
+		var req lib.CertRequest
+		if err := req.Sign("main", nonce(), cert, signer); err != nil {
+			t.Fatal(err)
+		}
+		return post(&req, reply)
+	}
+
+	// a certificate which outlives the session user's:
+	cert := signTestCert(t, userCA, key.PublicKey(), expires.Add(time.Hour), "ops")
+	var reply lib.CertReply
+	if code := request(cert, key, &reply); code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", code)
+	}
+	if reply.Username != "user_ca" || len(reply.AllowedLogins) != 1 || reply.AllowedLogins[0] != "guest" {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(reply.Cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, ok := pub.(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("expected a certificate, got %T", pub)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), proxyCA.PublicKey().Marshal())
+		},
+	}
+	if err = checker.CheckCert("guest", issued); err != nil {
+		t.Fatalf("the proxy must certify the key for the session user: %v", err)
+	}
+	if !bytes.Equal(issued.Key.Marshal(), key.PublicKey().Marshal()) {
+		t.Fatal("the proxy must certify the key of the party")
+	}
+	if issued.ValidBefore != template.ValidBefore {
+		t.Fatal("the certificate must not outlive the session user's")
+	}
+
+	// a short-lived certificate gets a short-lived one:
+	shortLived := signTestCert(t, userCA, key.PublicKey(), time.Now().Add(time.Minute), "ops")
+	if code := request(shortLived, key, &reply); code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", code)
+	}
+	pub, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(reply.Cert))
+	if pub.(*ssh.Certificate).ValidBefore != shortLived.ValidBefore {
+		t.Fatal("the certificate must not outlive the party's")
+	}
+
+	// untrusted CAs, other principals and other keys' holders are denied:
+	for _, c := range []*ssh.Certificate{
+		signTestCert(t, otherCA, key.PublicKey(), expires, "ops"),
+		signTestCert(t, userCA, key.PublicKey(), expires, "dev"),
+		signTestCert(t, userCA, key.PublicKey(), time.Now().Add(-time.Minute), "ops"),
+	} {
+		if code := request(c, key, nil); code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %v", code)
+		}
+	}
+	if code := request(cert, placeholder, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a request signed with another key, got %v", code)
+	}
+
+	// requests can't be replayed, nor made with nonces of our own or
+	// expired ones:
+	var req lib.CertRequest
+	if err = req.Sign("main", nonce(), cert, key); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(&req, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", code)
+	}
+	if code := post(&req, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a replayed request, got %v", code)
+	}
+	req.Sign("main", "made up", cert, key)
+	if code := post(&req, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a made up nonce, got %v", code)
+	}
+	expired, err := s.CertNonce(time.Now().Add(-certNonceTTL * 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Sign("main", expired, cert, key)
+	if code := post(&req, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for an expired nonce, got %v", code)
+	}
+
+	// a joiner without a trusted certificate gets no key to log in with:
+	resp, err := http.Get(ts.URL + "/api/sessions/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined lib.Session
+	err = json.NewDecoder(resp.Body).Decode(&joined)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(joined.Secrets.PrivKey) != 0 {
+		t.Fatal("joining parties must not get the proxy's CA private key")
+	}
+	for name, u := range joined.Secrets.Users {
+		if u.Key != nil && len(u.Key.Priv) != 0 {
+			t.Fatalf("joining parties must not get the private key of %v", name)
+		}
+	}
+	// their self-signed certificate, or the session user's (which they've
+	// got, but not its key), are no good:
+	for _, c := range []*ssh.Certificate{
+		signTestCert(t, key, key.PublicKey(), expires, "ops"),
+		signTestCert(t, proxyCA, key.PublicKey(), expires, "guest"),
+		template,
+	} {
+		if code := request(c, key, nil); code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %v", code)
+		}
+	}
+
+	// sessions with no trusted CAs don't give certificates:
+	s.session.TrustedCAs = nil
+	if code := request(cert, key, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", code)
+	}
+}
@@ -0,0 +1,566 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleconsole/lib"
+	"github.com/gravitational/teleport/integration"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/defaults"
+	tservice "github.com/gravitational/teleport/lib/service"
+	tsession "github.com/gravitational/teleport/lib/session"
+	"github.com/gravitational/teleport/lib/utils"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// ProxySiteName is the Teleport cluster name of every disposable proxy
+	ProxySiteName = "teleconsole-proxy"
+
+	// maxPINFailures is how many wrong PINs lock a client out of a
+	// PIN-protected session
+	maxPINFailures = 5
+
+	// maxPendingKnocks limits how many joining parties can wait for the
+	// broadcaster's approval at once
+	maxPendingKnocks = 10
+
+	// maxClientKnocks is how many times a client (by IP) can knock on a
+	// session: every knock is a question the broadcaster has to answer
+	maxClientKnocks = 5
+
+	// knockTTL is how long a knock waits for the broadcaster's decision
+	knockTTL = time.Minute * 2
+
+	// certNonceTTL is how long a certificate request nonce can be used
+	certNonceTTL = time.Minute
+
+	// maxCertNonces limits how many certificate request nonces can be
+	// waiting to be used at once
+	maxCertNonces = 100
+)
+
+// proxySession is a Teleconsole session served by a disposable Teleport proxy
+type proxySession struct {
+	sync.Mutex
+	session  lib.Session
+	proxy    *integration.TeleInstance
+	created  time.Time
+	lastSeen time.Time
+	// observerTSID is the Teleport session of read-only observers
+	observerTSID string
+
+	// pinLock serializes PIN checks, so wrong guesses are counted
+	// before the next one is checked
+	pinLock     sync.Mutex
+	pinVerifier string
+	// pinFailures counts wrong PINs by client IP
+	pinFailures map[string]int
+
+	// ownerToken authenticates the broadcaster
+	ownerToken string
+	// knocks of the parties who want to join (if approval is required)
+	knocks map[string]*knock
+	// clientKnocks counts knocks by client IP
+	clientKnocks map[string]int
+	// certNonces are the nonces issued for certificate requests, with the
+	// time they were issued at
+	certNonces map[string]time.Time
+	// bannedUsers are the Teleport users of kicked out parties
+	bannedUsers map[string]bool
+	// front accepts joining parties' connections to the proxy
+	front *front
+	// joinedAt is when Teleport parties have been first seen
+	joinedAt map[tsession.ID]time.Time
+}
+
+// knock is a request to join the session
+type knock struct {
+	lib.Knock
+	created time.Time
+}
+
+// startProxySession launches a new Teleport proxy (with auth server) on
+// 'host' trusting the secrets of the broadcaster's local Teleport instance
+func startProxySession(host string, req *lib.Session) (*proxySession, error) {
+	ports, err := lib.GetFreePorts(5)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	proxy := integration.NewInstance(ProxySiteName, host, ports, nil, nil)
+	// users announced by the broadcaster will receive certificates signed
+	// by this proxy, so they could log into it:
+	proxy.Secrets.Users = req.Secrets.Users
+
+	// it's the broadcaster who dials us via reverse tunnel, not vice versa:
+	trusted := req.Secrets
+	trusted.ListenAddr = ""
+
+	tconf := tservice.MakeDefaultConfig()
+	tconf.SSH.Enabled = false
+	tconf.Console = nil
+	tconf.Auth.NoAudit = true
+	tconf.Proxy.DisableWebUI = true
+	if err = proxy.CreateEx(trusted.AsSlice(), tconf); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	// joining parties can only reach the proxy through the front, while
+	// the reverse tunnel is still open for the broadcaster:
+	proxyAddr := net.JoinHostPort("127.0.0.1", proxy.GetPortProxy())
+	proxy.Config.Proxy.SSHAddr.Addr = proxyAddr
+	if err = proxy.Start(); err != nil {
+		os.RemoveAll(proxy.Config.DataDir)
+		return nil, trace.Wrap(err)
+	}
+	front, err := newFront(host, proxyAddr)
+	if err != nil {
+		proxy.Stop(true)
+		os.RemoveAll(proxy.Config.DataDir)
+		return nil, trace.Wrap(err)
+	}
+	ownerToken, err := utils.CryptoRandomHex(20)
+	if err != nil {
+		front.Close()
+		proxy.Stop(true)
+		os.RemoveAll(proxy.Config.DataDir)
+		return nil, trace.Wrap(err)
+	}
+	s := &proxySession{
+		session:    *req,
+		proxy:      proxy,
+		created:    time.Now(),
+		lastSeen:   time.Now(),
+		ownerToken: ownerToken,
+		knocks:     make(map[string]*knock),
+		front:      front,
+	}
+	s.session.Secrets = proxy.Secrets
+	s.pinVerifier = req.PINVerifier
+	s.session.PINVerifier = ""
+	s.session.PINProtected = s.pinVerifier != ""
+	s.session.ProxyHostPort = net.JoinHostPort(host, front.Port())
+	return s, nil
+}
+
+// IDs returns all web session IDs this session is known by
+func (this *proxySession) IDs() []string {
+	if this.session.ObserverID != "" {
+		return []string{this.session.ID, this.session.ObserverID}
+	}
+	return []string{this.session.ID}
+}
+
+// Session returns a copy of the session to send to clients who know it by
+// the given ID. Observers connect to the broadcaster's mirror as users of
+// their own and never learn the ID of the main session
+func (this *proxySession) Session(id string) *lib.Session {
+	this.Lock()
+	defer this.Unlock()
+	s := this.session
+	// kicked out parties' users are given to nobody:
+	users := lib.UserMap(s.Secrets.Users).Without(func(name string) bool {
+		return this.bannedUsers[name]
+	})
+	// observers only get the users which can't log into the shell, and
+	// nobody else gets those:
+	if id == s.ObserverID {
+		s.ID = s.ObserverID
+		s.TSID = this.observerTSID
+		s.ObserverID = ""
+		s.Observer = true
+		s.Secrets.Users = users.Without(func(name string) bool { return !lib.IsObserver(name) })
+	} else {
+		s.Secrets.Users = users.Without(lib.IsObserver)
+		s.MirrorAddr = ""
+	}
+	s.OwnerToken = ""
+	// nobody but the broadcaster gets the proxy's CA private key: with it
+	// anyone could certify keys for the proxy
+	s.Secrets.PrivKey = nil
+	return &s
+}
+
+// OwnerSession returns the copy of the session for the broadcaster, with
+// the owner token and the proxy's secrets their Teleport instance trusts
+func (this *proxySession) OwnerSession() *lib.Session {
+	this.Lock()
+	defer this.Unlock()
+	s := this.session
+	s.OwnerToken = this.ownerToken
+	return &s
+}
+
+// IsOwner returns true if the token belongs to the broadcaster
+func (this *proxySession) IsOwner(token string) bool {
+	return this.ownerToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(this.ownerToken)) == 1
+}
+
+// AddKnock registers a request to join the session via the given ID. It is
+// approved right away if the session does not require approval. A client
+// (by the knock's RemoteAddr) can only knock maxClientKnocks times
+func (this *proxySession) AddKnock(id string, k lib.Knock) (*lib.Knock, error) {
+	kid, err := utils.CryptoRandomHex(20)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	this.Lock()
+	defer this.Unlock()
+	k.ID = kid
+	k.Observer = id == this.session.ObserverID
+	// nothing to remember if there's nobody to approve:
+	if !this.session.ApprovalRequired {
+		k.Status = lib.KnockApproved
+		return &k, nil
+	}
+	this.expireKnocks(time.Now())
+	pending := 0
+	for _, k := range this.knocks {
+		if k.Status == lib.KnockPending {
+			pending++
+		}
+	}
+	if pending >= maxPendingKnocks {
+		return nil, trace.LimitExceeded("too many parties are waiting to join, try again later")
+	}
+	if this.clientKnocks[k.RemoteAddr] >= maxClientKnocks {
+		return nil, trace.LimitExceeded("you have knocked too many times, you can't join this session anymore")
+	}
+	if this.clientKnocks == nil {
+		this.clientKnocks = make(map[string]int)
+	}
+	this.clientKnocks[k.RemoteAddr]++
+	k.Status = lib.KnockPending
+	this.knocks[kid] = &knock{Knock: k, created: time.Now()}
+	return &k, nil
+}
+
+// GetKnock returns the knock with the given ID
+func (this *proxySession) GetKnock(kid string) (*lib.Knock, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.expireKnocks(time.Now())
+	k, ok := this.knocks[kid]
+	if !ok {
+		return nil, trace.NotFound("knock %v is not found", kid)
+	}
+	result := k.Knock
+	return &result, nil
+}
+
+// PendingKnocks returns the knocks waiting for the broadcaster's decision
+func (this *proxySession) PendingKnocks() []lib.Knock {
+	this.Lock()
+	defer this.Unlock()
+	this.expireKnocks(time.Now())
+	knocks := []lib.Knock{}
+	for _, k := range this.knocks {
+		if k.Status == lib.KnockPending {
+			knocks = append(knocks, k.Knock)
+		}
+	}
+	return knocks
+}
+
+// DecideKnock approves or denies a pending knock
+func (this *proxySession) DecideKnock(kid string, approved bool) error {
+	this.Lock()
+	defer this.Unlock()
+	k, ok := this.knocks[kid]
+	if !ok {
+		return trace.NotFound("knock %v is not found", kid)
+	}
+	if k.Status != lib.KnockPending {
+		return trace.CompareFailed("knock %v is already %v", kid, k.Status)
+	}
+	k.Status = lib.KnockDenied
+	if approved {
+		k.Status = lib.KnockApproved
+	}
+	return nil
+}
+
+// CheckKnock returns an error if the session requires approval and the
+// knock with the given ID has not been approved for joining via 'id'
+func (this *proxySession) CheckKnock(id, kid string) error {
+	this.Lock()
+	defer this.Unlock()
+	if !this.session.ApprovalRequired {
+		return nil
+	}
+	if kid == "" {
+		return trace.AccessDenied("this session requires the broadcaster's approval")
+	}
+	k, ok := this.knocks[kid]
+	if !ok || k.Status != lib.KnockApproved || k.Observer != (id == this.session.ObserverID) {
+		return trace.AccessDenied("the broadcaster has not approved you")
+	}
+	return nil
+}
+
+// expireKnocks denies the knocks nobody has decided on in time
+func (this *proxySession) expireKnocks(now time.Time) {
+	for _, k := range this.knocks {
+		if k.Status == lib.KnockPending && now.Sub(k.created) > knockTTL {
+			k.Status = lib.KnockDenied
+		}
+	}
+}
+
+// CheckPIN returns an error if the session is PIN-protected and the PIN is
+// wrong. After maxPINFailures wrong PINs the client (by IP) is locked out,
+// others can still join
+func (this *proxySession) CheckPIN(ip, pin string) error {
+	this.pinLock.Lock()
+	defer this.pinLock.Unlock()
+	if this.pinVerifier == "" {
+		return nil
+	}
+	if this.pinFailures[ip] >= maxPINFailures {
+		return trace.LimitExceeded("too many wrong PINs, you can't join this session anymore")
+	}
+	if pin == "" {
+		return trace.AccessDenied("this session is protected with a PIN")
+	}
+	if !lib.CheckPIN(this.pinVerifier, pin) {
+		if this.pinFailures == nil {
+			this.pinFailures = make(map[string]int)
+		}
+		this.pinFailures[ip]++
+		return trace.AccessDenied("wrong PIN")
+	}
+	return nil
+}
+
+// Publish sets the ID of the Teleport session to join via the given ID
+func (this *proxySession) Publish(id, tsid string) {
+	this.Lock()
+	defer this.Unlock()
+	if id == this.session.ObserverID {
+		this.observerTSID = tsid
+	} else {
+		this.session.TSID = tsid
+	}
+}
+
+// Stats asks the broadcaster's Teleport instance (via reverse tunnel) who
+// is connected to the session
+func (this *proxySession) Stats() (*lib.SessionStats, error) {
+	this.Lock()
+	tsid := this.session.TSID
+	observerTSID := this.observerTSID
+	siteName := this.session.Secrets.SiteName
+	this.Unlock()
+
+	stats := &lib.SessionStats{}
+	if tsid == "" {
+		return stats, nil
+	}
+	siteAPI, err := this.siteAPI(siteName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	ts, err := siteAPI.GetSession(defaults.Namespace, tsession.ID(tsid))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	parties := ts.Parties
+	observers := []tsession.Party{}
+	stats.TermWidth = ts.TerminalParams.W
+	stats.TermHeight = ts.TerminalParams.H
+
+	if observerTSID != "" {
+		ts, err = siteAPI.GetSession(defaults.Namespace, tsession.ID(observerTSID))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		observers = ts.Parties
+	}
+	// remember when we've first seen every party:
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	joinedAt := make(map[tsession.ID]time.Time)
+	stats.Parties = append(this.partiesOf(parties, false, now, joinedAt),
+		this.partiesOf(observers, true, now, joinedAt)...)
+	this.joinedAt = joinedAt
+	return stats, nil
+}
+
+// siteAPI returns the API of the broadcaster's Teleport instance
+func (this *proxySession) siteAPI(siteName string) (auth.ClientI, error) {
+	site, err := this.proxy.Tunnel.GetSite(siteName)
+	if err != nil {
+		return nil, trace.ConnectionProblem(err, "broadcaster is not connected")
+	}
+	siteAPI, err := site.GetClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return siteAPI, nil
+}
+
+// teleportParties returns the parties of the broadcaster's Teleport session
+func (this *proxySession) teleportParties() ([]tsession.Party, error) {
+	this.Lock()
+	tsid := this.session.TSID
+	siteName := this.session.Secrets.SiteName
+	this.Unlock()
+	if tsid == "" || this.proxy == nil {
+		return nil, nil
+	}
+	siteAPI, err := this.siteAPI(siteName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	ts, err := siteAPI.GetSession(defaults.Namespace, tsession.ID(tsid))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return ts.Parties, nil
+}
+
+// partiesOf converts Teleport parties, keeping track of when they've joined.
+// Parties of banned users are disconnected
+func (this *proxySession) partiesOf(tparties []tsession.Party, observer bool,
+	now time.Time, joinedAt map[tsession.ID]time.Time) (parties []lib.Party) {
+	for _, p := range tparties {
+		if this.bannedUsers[p.User] {
+			if this.front != nil {
+				this.front.Drop(p.RemoteAddr)
+			}
+			continue
+		}
+		joined, ok := this.joinedAt[p.ID]
+		if !ok {
+			joined = now
+		}
+		joinedAt[p.ID] = joined
+		party := lib.Party{
+			RemoteAddr: p.RemoteAddr,
+			LastActive: p.LastActive,
+			Observer:   observer,
+			JoinedAt:   joined,
+		}
+		if this.front != nil {
+			party.FullName = this.front.NameOf(p.RemoteAddr)
+		}
+		parties = append(parties, party)
+	}
+	return parties
+}
+
+// IsExpired returns true if the session has outlived its TTL or the
+// broadcaster's reverse tunnel has been gone for longer than orphanTTL
+func (this *proxySession) IsExpired(now time.Time, ttl, orphanTTL time.Duration) bool {
+	this.Lock()
+	defer this.Unlock()
+	if now.Sub(this.created) > ttl {
+		return true
+	}
+	if this.proxy.Tunnel != nil {
+		if _, err := this.proxy.Tunnel.GetSite(this.session.Secrets.SiteName); err == nil {
+			this.lastSeen = now
+		}
+	}
+	return now.Sub(this.lastSeen) > orphanTTL
+}
+
+// Parties returns the joining parties connected to the proxy
+func (this *proxySession) Parties() []lib.Party {
+	if this.front == nil {
+		return []lib.Party{}
+	}
+	return this.front.Parties()
+}
+
+// Announce remembers the display name (and the knock) of the party about
+// to connect from 'ip'
+func (this *proxySession) Announce(ip, name, knock string) {
+	if this.front != nil {
+		this.front.Announce(ip, lib.CleanName(name), knock)
+	}
+}
+
+// Kick disconnects a joining party and bars them from joining again: their
+// IP address is banned, their knock is revoked, and so is their Teleport
+// user unless others log in as the same user
+func (this *proxySession) Kick(pid string) error {
+	if this.front == nil {
+		return trace.NotFound("party %v is not found", pid)
+	}
+	// the user is only known while the party is connected:
+	parties, err := this.teleportParties()
+	if err != nil {
+		log.Warning(err)
+	}
+	c, err := this.front.Kick(pid)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	user := ""
+	for _, p := range parties {
+		if p.RemoteAddr == c.proxyAddr {
+			user = p.User
+		}
+	}
+	this.Lock()
+	if k, ok := this.knocks[c.knock]; ok {
+		k.Status = lib.KnockDenied
+	}
+	banned := this.banUser(user)
+	this.Unlock()
+	if banned {
+		// they may be connected from elsewhere too:
+		for _, p := range parties {
+			if p.User == user {
+				this.front.Drop(p.RemoteAddr)
+			}
+		}
+	}
+	log.Infof("session %v: kicked out %v (user %q, banned: %v)", this.session.ID, c.ip, user, banned)
+	return nil
+}
+
+// banUser bars the Teleport user from the session. The users everyone with
+// the session ID logs in as (their private keys are given away) are not
+// banned. Returns true if the user is banned
+func (this *proxySession) banUser(user string) bool {
+	u, ok := this.session.Secrets.Users[user]
+	if !ok || (u.Key != nil && len(u.Key.Priv) != 0) {
+		return false
+	}
+	if this.bannedUsers == nil {
+		this.bannedUsers = make(map[string]bool)
+	}
+	this.bannedUsers[user] = true
+	return true
+}
+
+// IsBannedUser returns true if the Teleport user has been kicked out
+func (this *proxySession) IsBannedUser(user string) bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.bannedUsers[user]
+}
+
+// IsBanned returns true if the IP address has been kicked out
+func (this *proxySession) IsBanned(ip string) bool {
+	return this.front != nil && this.front.IsBanned(ip)
+}
+
+// Stop shuts the disposable proxy down and deletes its data
+func (this *proxySession) Stop() {
+	if this.front != nil {
+		this.front.Close()
+	}
+	if err := this.proxy.Stop(true); err != nil {
+		log.Error(err)
+	}
+	os.RemoveAll(this.proxy.Config.DataDir)
+}